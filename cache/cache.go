@@ -0,0 +1,397 @@
+// Package cache skips work whose results are already known, by saving the
+// files a target creates under a digest of everything it depends on, and
+// restoring them the next time the same digest comes up.  Since the digest
+// covers the contents of the inputs rather than their modification times, a
+// target can be skipped even in a fresh checkout, and when the cache is kept in
+// a shared directory, by a different machine than the one that first ran it.
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/magefile/mage/internal"
+	"github.com/magefile/mage/mg"
+)
+
+// version is included in every key, so that changing how keys or manifests
+// are built invalidates the entries saved by older versions.
+const version = "mage cache 1"
+
+// ErrNotFound is returned by a Backend when it has nothing saved for a key.
+var ErrNotFound = errors.New("not found in cache")
+
+// Backend stores the blobs that make up a cache.  Keys are made up of
+// lowercase letters, digits and slashes.  Backends must be safe to use from
+// multiple goroutines.
+type Backend interface {
+	// Get returns the blob saved for key, or ErrNotFound if there isn't one.
+	Get(key string) (io.ReadCloser, error)
+	// Put saves the contents of r for key.  A blob that is only partly written
+	// must never be returned by Get.
+	Put(key string, r io.Reader) error
+}
+
+// Spec describes what a target depends on and what it creates.
+type Spec struct {
+	// Name is used in log messages, and is usually the name of the target.
+	Name string
+	// Inputs are the files the target reads.  They may be files, directories
+	// or patterns, as with target.Glob.  The contents of the files are part of
+	// the key, but not their modification times.
+	Inputs []string
+	// Env are the names of environment variables whose values are part of the
+	// key.
+	Env []string
+	// Commands are the command lines the target runs.  They're part of the key,
+	// so that changing a command runs the target again.
+	Commands [][]string
+	// Outputs are the files and directories the target creates, which are
+	// saved after it runs and restored instead of running it.  They must be
+	// relative paths under the current directory.  Restoring an output replaces
+	// all of it, so files in an output directory that the target didn't create
+	// are removed.
+	Outputs []string
+}
+
+// Stats counts how often a Cache could skip running a target.
+type Stats struct {
+	Hits   int64
+	Misses int64
+}
+
+// Cache runs targets and saves their outputs in a Backend.
+type Cache struct {
+	backend Backend
+	hits    int64
+	misses  int64
+}
+
+// New returns a Cache that stores its entries in backend.
+func New(backend Backend) *Cache {
+	return &Cache{backend: backend}
+}
+
+// Default is the cache used by the package level functions.  It is kept in the
+// "build" directory under mg.CacheDir(), which is looked up each time the cache
+// is used, so that it follows changes to MAGEFILE_CACHE.
+var Default = New(defaultDir{})
+
+// defaultDir is the Backend of Default.
+type defaultDir struct{}
+
+func (defaultDir) dir() Dir {
+	return Dir(filepath.Join(mg.CacheDir(), "build"))
+}
+
+// Get implements Backend.
+func (d defaultDir) Get(key string) (io.ReadCloser, error) {
+	return d.dir().Get(key)
+}
+
+// Put implements Backend.
+func (d defaultDir) Put(key string, r io.Reader) error {
+	return d.dir().Put(key, r)
+}
+
+var logger = log.New(os.Stderr, "", 0)
+
+// Run calls Default.Run.
+func Run(spec Spec, fn func() error) (hit bool, err error) {
+	return Default.Run(spec, fn)
+}
+
+// Run restores the outputs of spec and returns true if they were saved by an
+// earlier run with the same inputs, environment and commands.  Otherwise it
+// calls fn, and if fn succeeds, saves the outputs for next time.  It's an error
+// if fn doesn't create all of the outputs.
+func (c *Cache) Run(spec Spec, fn func() error) (hit bool, err error) {
+	for _, out := range spec.Outputs {
+		if name := path.Clean(filepath.ToSlash(out)); name == "." || !inOutputs(name, spec.Outputs) {
+			return false, fmt.Errorf("output %s of %s must be a path under the current directory", out, spec.Name)
+		}
+	}
+	key, err := Key(spec)
+	if err != nil {
+		return false, err
+	}
+	if err := c.restore(key, spec.Outputs); err == nil {
+		atomic.AddInt64(&c.hits, 1)
+		if mg.Verbose() {
+			logger.Println("Cache hit:", spec.Name)
+		}
+		return true, nil
+	} else if err != ErrNotFound {
+		// a broken entry is no worse than a missing one, the target can still
+		// be run to replace it.
+		if mg.Verbose() {
+			logger.Printf("Error restoring %s from cache: %v", spec.Name, err)
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+	if mg.Verbose() {
+		logger.Println("Cache miss:", spec.Name)
+	}
+	if err := fn(); err != nil {
+		return false, err
+	}
+	if err := c.save(key, spec.Outputs); err != nil {
+		return false, fmt.Errorf("can't save %s to cache: %v", spec.Name, err)
+	}
+	return false, nil
+}
+
+// Stats returns the number of hits and misses from calls to Run.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// Key returns the digest of the inputs, environment, commands and the names of
+// the outputs of spec, which is what a cache entry is saved under.
+func Key(spec Spec) (string, error) {
+	files, err := internal.ExpandSources(spec.Inputs)
+	if err != nil {
+		return "", err
+	}
+	lines := make([]string, 0, len(files))
+	for _, f := range files {
+		d, err := internal.HashFile(f)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf("input %q %s", filepath.ToSlash(f), d))
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	fmt.Fprintln(h, version)
+	for _, l := range lines {
+		fmt.Fprintln(h, l)
+	}
+	env := append([]string(nil), spec.Env...)
+	sort.Strings(env)
+	for _, name := range env {
+		if val, ok := os.LookupEnv(name); ok {
+			fmt.Fprintf(h, "env %q %q\n", name, val)
+		} else {
+			fmt.Fprintf(h, "unset %q\n", name)
+		}
+	}
+	for _, cmd := range spec.Commands {
+		fmt.Fprintf(h, "command %q\n", cmd)
+	}
+	for _, out := range spec.Outputs {
+		fmt.Fprintf(h, "output %q\n", filepath.ToSlash(out))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifest lists the files and directories saved for a cache entry.
+// Directories are listed so that those left empty are restored too.
+type manifest struct {
+	Dirs  []string       `json:"dirs,omitempty"` // slash separated paths
+	Files []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Path   string      `json:"path"`   // the slash separated path of the file
+	Mode   os.FileMode `json:"mode"`   // the permissions of the file
+	Digest string      `json:"digest"` // the key of the file's contents
+}
+
+// save stores the files in outputs as blobs named by their digests, and then a
+// manifest of them under key.  The manifest is saved last, so that an entry is
+// never found without all of its files.
+func (c *Cache) save(key string, outputs []string) error {
+	var m manifest
+	for _, out := range outputs {
+		stat, err := os.Stat(out)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("output %s was not created", out)
+		}
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			if err := c.saveFile(&m, out, stat.Mode()); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.Walk(out, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				m.Dirs = append(m.Dirs, filepath.ToSlash(path))
+				return nil
+			}
+			return c.saveFile(&m, path, info.Mode())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.backend.Put(actionKey(key), bytes.NewReader(b))
+}
+
+func (c *Cache) saveFile(m *manifest, path string, mode os.FileMode) error {
+	d, err := internal.HashFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := c.backend.Put(blobKey(d), f); err != nil {
+		return err
+	}
+	m.Files = append(m.Files, manifestFile{Path: filepath.ToSlash(path), Mode: mode.Perm(), Digest: d})
+	return nil
+}
+
+// restore replaces outputs with the files saved under key.  It returns
+// ErrNotFound if there is no entry for key.
+func (c *Cache) restore(key string, outputs []string) error {
+	r, err := c.backend.Get(actionKey(key))
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("invalid cache entry %s: %v", key, err)
+	}
+	// the manifest may come from a shared cache, so it's only trusted to
+	// write files inside the outputs.
+	for _, dir := range m.Dirs {
+		if !inOutputs(dir, outputs) {
+			return fmt.Errorf("invalid cache entry %s: %q is not in the outputs", key, dir)
+		}
+	}
+	for _, f := range m.Files {
+		if !inOutputs(f.Path, outputs) {
+			return fmt.Errorf("invalid cache entry %s: %q is not in the outputs", key, f.Path)
+		}
+		if !validDigest(f.Digest) {
+			return fmt.Errorf("invalid cache entry %s: bad digest for %q", key, f.Path)
+		}
+	}
+	// remove the outputs first, so that files that were left in an output
+	// directory by another run don't end up mixed in with the restored ones.
+	for _, out := range outputs {
+		if err := os.RemoveAll(out); err != nil {
+			return err
+		}
+	}
+	for _, dir := range m.Dirs {
+		if err := os.MkdirAll(filepath.FromSlash(dir), 0755); err != nil {
+			return err
+		}
+	}
+	for _, f := range m.Files {
+		if err := c.restoreFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) restoreFile(f manifestFile) error {
+	r, err := c.backend.Get(blobKey(f.Digest))
+	if err == ErrNotFound {
+		return fmt.Errorf("missing contents of %s", f.Path)
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	path := filepath.FromSlash(f.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a failed restore
+	// doesn't leave a partial output behind that looks up to date.
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// inOutputs reports whether the slash separated name is one of outputs, or a
+// file under one of them.  Names that are absolute or go up a directory are
+// never in the outputs.
+func inOutputs(name string, outputs []string) bool {
+	native := filepath.FromSlash(name)
+	if name == "" || path.IsAbs(name) || filepath.IsAbs(native) || filepath.VolumeName(native) != "" {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	name = path.Clean(name)
+	for _, out := range outputs {
+		out = path.Clean(filepath.ToSlash(out))
+		if name == out || strings.HasPrefix(name, out+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validDigest reports whether d looks like a digest made by internal.HashFile,
+// so that it's safe to use in a key.
+func validDigest(d string) bool {
+	if len(d) < 2 {
+		return false
+	}
+	_, err := hex.DecodeString(d)
+	return err == nil
+}
+
+func actionKey(key string) string {
+	return "actions/" + key[:2] + "/" + key
+}
+
+func blobKey(digest string) string {
+	return "blobs/" + digest[:2] + "/" + digest
+}
@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magefile/mage/mg"
+)
+
+// withCache changes to a new temporary directory and returns a Cache kept in a
+// directory outside of it, until restore is called.
+func withCache(t *testing.T) (c *Cache, restore func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(work); err != nil {
+		t.Fatal(err)
+	}
+	return New(Dir(filepath.Join(dir, "cache"))), func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	writeFile(t, "src/a.txt", "a")
+	writeFile(t, "src/b.txt", "b")
+	spec := Spec{
+		Name:     "Build",
+		Inputs:   []string{"src"},
+		Commands: [][]string{{"cat", "src/a.txt", "src/b.txt"}},
+		Outputs:  []string{"out.txt", "gen"},
+	}
+	runs := 0
+	build := func() error {
+		runs++
+		writeFile(t, "gen/x/y.txt", "generated")
+		return ioutil.WriteFile("out.txt", []byte("ab"), 0755)
+	}
+	check := func(wantHit bool, wantRuns int) {
+		t.Helper()
+		hit, err := c.Run(spec, build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != wantHit {
+			t.Fatalf("expected hit to be %v", wantHit)
+		}
+		if runs != wantRuns {
+			t.Fatalf("expected %d runs, got %d", wantRuns, runs)
+		}
+	}
+
+	check(false, 1)
+	// simulate a fresh checkout, where the outputs don't exist and the inputs
+	// have new modtimes.
+	os.RemoveAll("gen")
+	os.Remove("out.txt")
+	writeFile(t, "src/a.txt", "a")
+	check(true, 1)
+	b, err := ioutil.ReadFile("gen/x/y.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "generated" {
+		t.Fatalf("expected restored output %q, got %q", "generated", b)
+	}
+	stat, err := os.Stat("out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0755 {
+		t.Fatalf("expected restored mode 0755, got %v", stat.Mode().Perm())
+	}
+
+	writeFile(t, "src/a.txt", "changed")
+	check(false, 2)
+
+	spec.Commands = [][]string{{"cat", "src/b.txt", "src/a.txt"}}
+	check(false, 3)
+
+	if s := c.Stats(); s.Hits != 1 || s.Misses != 3 {
+		t.Fatalf("expected 1 hit and 3 misses, got %+v", s)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	const env = "MAGE_CACHE_TEST"
+	os.Unsetenv(env)
+	defer os.Unsetenv(env)
+	spec := Spec{Env: []string{env}, Outputs: []string{"out.txt"}}
+	build := func() error {
+		return ioutil.WriteFile("out.txt", []byte(os.Getenv(env)), 0644)
+	}
+	keys := map[string]bool{}
+	for _, val := range []string{"unset", "", "x"} {
+		if val != "unset" {
+			os.Setenv(env, val)
+		}
+		key, err := Key(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[key] = true
+		if hit, err := c.Run(spec, build); err != nil || hit {
+			t.Fatalf("expected miss for %s=%q, got %v, %v", env, val, hit, err)
+		}
+		if hit, err := c.Run(spec, build); err != nil || !hit {
+			t.Fatalf("expected hit for %s=%q, got %v, %v", env, val, hit, err)
+		}
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected a different key for each value, got %d keys", len(keys))
+	}
+}
+
+func TestRunMissingOutput(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	spec := Spec{Name: "Build", Outputs: []string{"out.txt"}}
+	if _, err := c.Run(spec, func() error { return nil }); err == nil {
+		t.Fatal("expected error for output that wasn't created")
+	}
+	// nothing should have been saved.
+	runs := 0
+	c.Run(spec, func() error {
+		runs++
+		return ioutil.WriteFile("out.txt", nil, 0644)
+	})
+	if runs != 1 {
+		t.Fatal("expected target to run again after failing to save")
+	}
+}
+
+func TestRunMissingBlob(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	spec := Spec{Outputs: []string{"out.txt"}}
+	build := func() error { return ioutil.WriteFile("out.txt", []byte("out"), 0644) }
+	if _, err := c.Run(spec, build); err != nil {
+		t.Fatal(err)
+	}
+	dir := string(c.backend.(Dir))
+	if err := os.RemoveAll(filepath.Join(dir, "blobs")); err != nil {
+		t.Fatal(err)
+	}
+	hit, err := c.Run(spec, build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit {
+		t.Fatal("expected a miss for an entry with missing contents")
+	}
+}
+
+func TestRunRemovesStaleFiles(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	spec := Spec{Outputs: []string{"gen"}}
+	build := func() error {
+		writeFile(t, "gen/a.txt", "a")
+		return nil
+	}
+	if _, err := c.Run(spec, build); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "gen/stale.txt", "stale")
+	hit, err := c.Run(spec, build)
+	if err != nil || !hit {
+		t.Fatalf("expected hit, got %v, %v", hit, err)
+	}
+	if _, err := os.Stat("gen/stale.txt"); !os.IsNotExist(err) {
+		t.Fatalf("expected the stale file to be removed, got %v", err)
+	}
+	if _, err := os.Stat("gen/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunEmptyDir(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	spec := Spec{Outputs: []string{"gen"}}
+	build := func() error {
+		return os.MkdirAll(filepath.Join("gen", "empty"), 0755)
+	}
+	if _, err := c.Run(spec, build); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll("gen"); err != nil {
+		t.Fatal(err)
+	}
+	hit, err := c.Run(spec, build)
+	if err != nil || !hit {
+		t.Fatalf("expected hit, got %v, %v", hit, err)
+	}
+	if stat, err := os.Stat(filepath.Join("gen", "empty")); err != nil || !stat.IsDir() {
+		t.Fatalf("expected the empty directory to be restored, got %v", err)
+	}
+}
+
+func TestRunUnsafeManifest(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	spec := Spec{Outputs: []string{"out.txt"}}
+	key, err := Key(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := strings.Repeat("ab", 32)
+	if err := c.backend.Put(blobKey(digest), strings.NewReader("evil")); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"../evil.txt", "out.txt/../../evil.txt", "/tmp/evil.txt", "other.txt"} {
+		m := fmt.Sprintf(`{"files":[{"path":%q,"mode":420,"digest":%q}]}`, path, digest)
+		if err := c.backend.Put(actionKey(key), strings.NewReader(m)); err != nil {
+			t.Fatal(err)
+		}
+		runs := 0
+		hit, err := c.Run(spec, func() error {
+			runs++
+			return ioutil.WriteFile("out.txt", nil, 0644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit || runs != 1 {
+			t.Fatalf("expected the target to run instead of restoring %q", path)
+		}
+		for _, p := range []string{"../evil.txt", "/tmp/evil.txt", "other.txt"} {
+			if _, err := os.Stat(p); err == nil {
+				t.Fatalf("%q was restored to %s", path, p)
+			}
+		}
+	}
+}
+
+func TestRunOutputOutsideDir(t *testing.T) {
+	c, restore := withCache(t)
+	defer restore()
+	for _, out := range []string{"../out.txt", ".", "/tmp/out.txt"} {
+		runs := 0
+		_, err := c.Run(Spec{Outputs: []string{out}}, func() error {
+			runs++
+			return nil
+		})
+		if err == nil || runs != 0 {
+			t.Fatalf("expected an error without running for output %q, got %v", out, err)
+		}
+	}
+}
+
+func TestDefaultFollowsCacheDir(t *testing.T) {
+	_, restore := withCache(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old, ok := os.LookupEnv(mg.CacheEnv)
+	os.Setenv(mg.CacheEnv, dir)
+	defer func() {
+		if ok {
+			os.Setenv(mg.CacheEnv, old)
+		} else {
+			os.Unsetenv(mg.CacheEnv)
+		}
+	}()
+	spec := Spec{Outputs: []string{"out.txt"}}
+	key, err := Key(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Run(spec, func() error { return ioutil.WriteFile("out.txt", nil, 0644) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(Dir(filepath.Join(dir, "build")).path(actionKey(key))); err != nil {
+		t.Fatalf("expected the entry to be saved under %s: %v", dir, err)
+	}
+}
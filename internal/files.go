@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExpandSources returns the files named by sources, which may be files,
+// directories, which include all the files under them, or patterns, which are
+// matched against the files under the current directory with Glob.  It's an
+// error if any sources that aren't patterns don't exist.
+func ExpandSources(sources []string) ([]string, error) {
+	var files, patterns []string
+	for _, src := range sources {
+		if strings.HasPrefix(src, "!") || strings.ContainsAny(src, "*?[") {
+			patterns = append(patterns, filepath.ToSlash(src))
+			continue
+		}
+		stat, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		if !stat.IsDir() {
+			files = append(files, src)
+			continue
+		}
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(patterns) > 0 {
+		matches, err := Glob(".", patterns)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			files = append(files, filepath.FromSlash(m))
+		}
+	}
+	return files, nil
+}
+
+// StaleOutputs returns the destinations that are missing or have been modified
+// less recently than the newest of the sources, which are expanded with
+// ExpandSources.  Destinations that are directories are compared by the newest
+// modtime of the files under them.
+func StaleOutputs(dsts []string, sources []string) (stale []string, err error) {
+	files, err := ExpandSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	var newest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	for _, dst := range dsts {
+		stat, err := os.Stat(dst)
+		if os.IsNotExist(err) {
+			stale = append(stale, dst)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t := stat.ModTime()
+		if stat.IsDir() {
+			t, err = dirModTime(dst)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if newest.After(t) {
+			stale = append(stale, dst)
+		}
+	}
+	return stale, nil
+}
+
+// dirModTime returns the newest modtime of dir and everything under it.
+func dirModTime(dir string) (time.Time, error) {
+	var t time.Time
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+		return nil
+	})
+	return t, err
+}
+
+// HashFile returns the hex encoded SHA-256 digest of the contents of the file
+// at path.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("can't hash %s: %v", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
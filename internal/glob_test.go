@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/app/main.go", true},
+		{"cmd/**", "cmd/app/main.go", true},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/**/main.go", "pkg/main.go", false},
+		{"testdata/**", "testdata", true},
+		{"go.mod", "go.mod", true},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		if actual := MatchGlob(tt.pattern, tt.name); actual != tt.match {
+			t.Errorf("MatchGlob(%q, %q) = %v, expected %v", tt.pattern, tt.name, actual, tt.match)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"main.go", "go.mod", "README.md", "cmd/app/app.go", "testdata/data.go", ".git/hooks.go"} {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	actual, err := Glob(dir, []string{"**/*.go", "go.mod", "!testdata/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"cmd/app/app.go", "go.mod", "main.go"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected %v, but got %v", expected, actual)
+	}
+}
@@ -0,0 +1,20 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LowerFirst lowercases the first letter of each part of a target name, which
+// is how targets are listed.
+func LowerFirst(s string) string {
+	parts := strings.Split(s, ":")
+	for i, t := range parts {
+		r, n := utf8.DecodeRuneInString(t)
+		if n > 0 {
+			parts[i] = string(unicode.ToLower(r)) + t[n:]
+		}
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,18 @@
+package internal
+
+import "testing"
+
+func TestLowerFirst(t *testing.T) {
+	tests := map[string]string{
+		"Build":    "build",
+		"NS:Lint":  "nS:lint",
+		"ÉtéBuild": "étéBuild",
+		"Deploy:":  "deploy:",
+		"":         "",
+	}
+	for in, expected := range tests {
+		if actual := LowerFirst(in); actual != expected {
+			t.Errorf("expected LowerFirst(%q) to be %q, got %q", in, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+//+build !windows
+
+package internal
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// SetProcessGroup makes c the leader of a new process group, so that the
+// processes it starts can be stopped along with it.  Commands that read from a
+// terminal are left in mage's process group, so that they can still read from
+// it, and are stopped on their own.
+func SetProcessGroup(c *exec.Cmd) {
+	if IsTerminal(c.Stdin) {
+		return
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// InterruptProcessGroup sends an interrupt to c, and the process group it
+// leads if it has one, as if ctrl-c had been pressed in a terminal running it.
+func InterruptProcessGroup(c *exec.Cmd) error {
+	return signalProcessGroup(c, syscall.SIGINT)
+}
+
+// TerminateProcessGroup asks c, and the process group it leads if it has one,
+// to exit.
+func TerminateProcessGroup(c *exec.Cmd) error {
+	return signalProcessGroup(c, syscall.SIGTERM)
+}
+
+// KillProcessGroup kills c, and the process group it leads if it has one.
+func KillProcessGroup(c *exec.Cmd) error {
+	return signalProcessGroup(c, syscall.SIGKILL)
+}
+
+func signalProcessGroup(c *exec.Cmd, sig syscall.Signal) error {
+	pid := c.Process.Pid
+	if c.SysProcAttr != nil && c.SysProcAttr.Setpgid {
+		pid = -pid
+	}
+	return syscall.Kill(pid, sig)
+}
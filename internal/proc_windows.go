@@ -0,0 +1,22 @@
+package internal
+
+import (
+	"os/exec"
+)
+
+// Windows can't ask another process to exit or send it an interrupt, so
+// commands are just killed.
+
+func SetProcessGroup(c *exec.Cmd) {}
+
+func InterruptProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+func TerminateProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+func KillProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -112,3 +113,20 @@ func EnvWithGOOS(goos, goarch string) ([]string, error) {
 	}
 	return joinEnv(env), nil
 }
+
+// IsTerminal reports whether r is a terminal, or another character device
+// other than the null device.  Commands reading from it must stay in the
+// terminal's foreground process group, since a process in another group is
+// stopped if it reads from the terminal.
+func IsTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok || f == nil {
+		return false
+	}
+	stat, err := f.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(stat, null)
+}
@@ -0,0 +1,32 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestIsTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	for name, reader := range map[string]io.Reader{
+		"reader":   strings.NewReader(""),
+		"null":     null,
+		"pipe":     r,
+		"nil file": (*os.File)(nil),
+	} {
+		if IsTerminal(reader) {
+			t.Errorf("expected %s not to be a terminal", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package mage
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magefile/mage/internal"
+)
+
+// depsTemplate is the format go list prints each package the magefiles depend
+// on in.  Packages in the standard library are left out, since they are covered
+// by the go version.  Each package's files include everything that goes into
+// building it, including files in other languages and embedded files.
+const depsTemplate = `{{if not .Standard}}{{.ImportPath}}||` +
+	`{{with .Module}}{{if not .Replace}}{{.Version}}{{end}}{{end}}||{{.Dir}}||` +
+	`{{join .GoFiles ":"}}:{{join .CgoFiles ":"}}:{{join .CFiles ":"}}:{{join .CXXFiles ":"}}:` +
+	`{{join .MFiles ":"}}:{{join .HFiles ":"}}:{{join .FFiles ":"}}:{{join .SFiles ":"}}:` +
+	`{{join .SwigFiles ":"}}:{{join .SwigCXXFiles ":"}}:{{join .SysoFiles ":"}}:{{join .EmbedFiles ":"}}{{end}}`
+
+// depsHash returns a hash of everything the magefiles depend on, other than
+// the standard library: the files in the packages they import, directly or
+// not, and the go.mod and go.sum of the module they are in.  Packages from a
+// module downloaded at a known version are hashed by that version rather than
+// by their files, since they can't change.  Build flags are passed to go list,
+// so that the packages are chosen the way go build would choose them.
+func depsHash(goCmd string, flags, files []string) (string, error) {
+	start := time.Now()
+	defer func() {
+		debug.Println("time to hash magefile dependencies:", time.Since(start))
+	}()
+	if len(files) == 0 {
+		return "", nil
+	}
+	// go list must see the same environment as Compile, which builds for the
+	// current OS and architecture.
+	env, err := internal.EnvWithGOOS("", "")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(files[0])
+	args := append([]string{"list", "-deps", "-e", "-f", depsTemplate}, flags...)
+	for _, f := range files {
+		args = append(args, filepath.Base(f))
+	}
+	c := exec.Command(goCmd, args...)
+	c.Env = env
+	c.Dir = dir
+	b, err := c.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list magefile dependencies: %v", err)
+	}
+
+	h := sha1.New()
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		parts := strings.Split(line, "||")
+		if len(parts) != 4 {
+			continue
+		}
+		path, version, pkgDir, names := parts[0], parts[1], parts[2], parts[3]
+		if version != "" {
+			fmt.Fprintf(h, "%s@%s\n", path, version)
+			continue
+		}
+		fmt.Fprintf(h, "%s\n", path)
+		for _, name := range strings.Split(names, ":") {
+			if name == "" {
+				continue
+			}
+			if err := hashInto(h, filepath.Join(pkgDir, name)); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if mod := moduleFile(dir); mod != "" {
+		for _, f := range []string{mod, filepath.Join(filepath.Dir(mod), "go.sum")} {
+			if err := hashInto(h, f); err != nil && !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+	// these change how packages are built without changing what's in them.
+	for _, env := range []string{"GOFLAGS", "CGO_ENABLED"} {
+		fmt.Fprintf(h, "%s=%s\n", env, os.Getenv(env))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashInto writes the name and contents of the file at path to h.
+func hashInto(h io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "%s\n", path)
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// moduleFile returns the go.mod of the module dir is in, or "" if it isn't in
+// one.
+func moduleFile(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if isModuleRoot(abs) {
+			return filepath.Join(abs, "go.mod")
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return ""
+		}
+		abs = parent
+	}
+}
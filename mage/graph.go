@@ -0,0 +1,167 @@
+package mage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/magefile/mage/parse"
+)
+
+// runGraph prints the dependency graph of the magefiles in inv.Dir, limited to
+// the dependencies of the target in inv.Args, if any.
+func runGraph(inv Invocation) int {
+	errlog := log.New(inv.Stderr, "", 0)
+	if inv.GoCmd == "" {
+		inv.GoCmd = "go"
+	}
+	root, dir, files, err := searchMagefiles(inv)
+	if err != nil {
+		errlog.Println("Error determining list of magefiles:", err)
+		return 1
+	}
+	inv.Dir = root
+	if len(files) == 0 {
+		errlog.Println(noMagefiles(inv, dir))
+		return 1
+	}
+	fnames := make([]string, 0, len(files))
+	for i := range files {
+		fnames = append(fnames, filepath.Base(files[i]))
+	}
+	if inv.Debug {
+		parse.EnableDebug()
+	}
+	info, err := parse.PrimaryPackage(inv.GoCmd, dir, fnames)
+	if err != nil {
+		errlog.Println("Error parsing magefiles:", err)
+		return 1
+	}
+	g := parse.DepGraph(info)
+	if len(inv.Args) > 0 {
+		name, ok := graphTarget(g, info, inv.Args[0])
+		if !ok {
+			errlog.Println("Unknown target specified:", inv.Args[0])
+			return 2
+		}
+		g = subGraph(g, name)
+	}
+	if inv.JSON {
+		err = writeGraphJSON(inv.Stdout, g)
+	} else {
+		err = writeGraphDOT(inv.Stdout, g)
+	}
+	if err != nil {
+		errlog.Println("Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// graphTarget returns the name of the node in g for the given target or alias.
+func graphTarget(g *parse.Graph, info *parse.PkgInfo, target string) (string, bool) {
+	for alias, f := range info.Aliases {
+		if strings.EqualFold(alias, target) {
+			target = f.TargetName()
+			break
+		}
+	}
+	for _, n := range g.Nodes {
+		if n.Target && strings.EqualFold(n.Name, target) {
+			return n.Name, true
+		}
+	}
+	return "", false
+}
+
+// subGraph returns the part of g reachable from the named node.
+func subGraph(g *parse.Graph, name string) *parse.Graph {
+	seen := map[string]bool{}
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		if n := g.Node(name); n != nil {
+			for _, e := range n.Deps {
+				if e.Resolved {
+					visit(e.Name)
+				}
+			}
+		}
+	}
+	visit(name)
+	sub := &parse.Graph{}
+	for _, n := range g.Nodes {
+		if seen[n.Name] {
+			sub.Nodes = append(sub.Nodes, n)
+		}
+	}
+	return sub
+}
+
+func writeGraphJSON(w io.Writer, g *parse.Graph) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// writeGraphDOT writes g in Graphviz DOT format.  Targets are drawn as boxes,
+// other functions as ellipses, and dependencies that could not be resolved
+// statically as dashed red nodes, which are given IDs of their own so that they
+// can't be confused with functions of the same name.  Serial dependencies are
+// labelled with their order, and dependencies declared with mg.F with their
+// arguments.
+func writeGraphDOT(w io.Writer, g *parse.Graph) error {
+	lines := []string{"digraph mage {"}
+	for _, n := range g.Nodes {
+		shape := "ellipse"
+		if n.Target {
+			shape = "box"
+		}
+		lines = append(lines, fmt.Sprintf("\t%q [shape=%s];", n.Name, shape))
+	}
+	unresolved := map[string]string{} // node IDs by expression
+	for _, n := range g.Nodes {
+		serial := 0
+		for _, e := range n.Deps {
+			var attrs, label []string
+			if e.Serial {
+				serial++
+				label = append(label, fmt.Sprint(serial))
+			}
+			if e.Args != "" {
+				label = append(label, "("+e.Args+")")
+			}
+			if len(label) > 0 {
+				attrs = append(attrs, fmt.Sprintf("label=%q", strings.Join(label, " ")))
+			}
+			to := e.Name
+			if !e.Resolved {
+				attrs = append(attrs, "style=dashed", "color=red")
+				id, ok := unresolved[e.Name]
+				if !ok {
+					id = fmt.Sprintf("unresolved %d", len(unresolved)+1)
+					unresolved[e.Name] = id
+					lines = append(lines, fmt.Sprintf("\t%q [label=%q, style=dashed, color=red];", id, e.Name))
+				}
+				to = id
+			}
+			line := fmt.Sprintf("\t%q -> %q", n.Name, to)
+			if len(attrs) > 0 {
+				line += " [" + strings.Join(attrs, ", ") + "]"
+			}
+			lines = append(lines, line+";")
+		}
+	}
+	lines = append(lines, "}")
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -1,7 +1,9 @@
 package mage
 
 import (
+	"context"
 	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,10 +15,10 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
-	"unicode"
 
 	"github.com/magefile/mage/internal"
 	"github.com/magefile/mage/mg"
@@ -31,21 +33,29 @@ import (
 const magicRebuildKey = "v0.3"
 
 var mainfileTemplate = template.Must(template.New("").Funcs(map[string]interface{}{
-	"lower": strings.ToLower,
-	"lowerFirst": func(s string) string {
-		parts := strings.Split(s, ":")
-		for i, t := range parts {
-			r := []rune(t)
-			parts[i] = string(unicode.ToLower(r[0])) + string(r[1:])
-		}
-		return strings.Join(parts, ":")
-	},
+	"lower":      strings.ToLower,
+	"lowerFirst": internal.LowerFirst,
 }).Parse(mageMainfileTplString))
 var initOutput = template.Must(template.New("").Parse(mageTpl))
 
 const mainfile = "mage_output_file.go"
 const initFile = "magefile.go"
 
+// MagefilesDirName is the name of the directory that, if it exists in the
+// directory mage is run in, holds the magefiles instead.  The magefiles in it
+// are an ordinary main package, so they don't need the mage build tag.
+const MagefilesDirName = "magefiles"
+
+// Environment variables that set the defaults for the flags mage passes to the
+// go tool when compiling magefiles.
+const (
+	TagsEnv     = "MAGEFILE_TAGS"
+	LdflagsEnv  = "MAGEFILE_LDFLAGS"
+	TrimpathEnv = "MAGEFILE_TRIMPATH"
+	RaceEnv     = "MAGEFILE_RACE"
+	ModEnv      = "MAGEFILE_MOD"
+)
+
 var debug = log.New(ioutil.Discard, "DEBUG: ", log.Ltime|log.Lmicroseconds)
 
 // set by ldflags when you "mage build"
@@ -67,6 +77,8 @@ const (
 	Init                  // create a starting template for mage
 	Clean                 // clean out old compiled mage binaries from the cache
 	CompileStatic         // compile a static binary of the current directory
+	Graph                 // print the dependency graph of the targets
+	Watch                 // run a target, and rerun it when files change
 )
 
 // Main is the entrypoint for running mage.  It exists external to mage's main
@@ -79,16 +91,29 @@ func Main() int {
 // Invocation contains the args for invoking a run of Mage.
 type Invocation struct {
 	Debug      bool          // turn on debug messages
-	Dir        string        // directory to read magefiles from
+	Dir        string        // directory to read magefiles from (default: the nearest one with magefiles)
+	WorkDir    string        // directory to run targets in, if different from Dir
 	Force      bool          // forces recreation of the compiled binary
 	Verbose    bool          // tells the magefile to print out log statements
+	DryRun     bool          // tells the magefile to print what would run instead of running commands
+	Jobs       int           // tells the magefile the maximum number of dependencies to run at once
+	Timing     bool          // tells the magefile to print how long each target and dependency took
+	Trace      string        // tells the magefile to write a trace of the targets and dependencies to this file
+	Prefix     bool          // tells the magefile to prefix each line of command output with the target's name
+	Buffer     bool          // tells the magefile to write the command output of each dependency when it finishes
 	List       bool          // tells the magefile to print out a list of targets
+	JSON       bool          // tells the magefile to print the list of targets as JSON
 	Help       bool          // tells the magefile to print out help for a specific target
 	Keep       bool          // tells mage to keep the generated main file after compiling
 	Timeout    time.Duration // tells mage to set a timeout to running the targets
 	CompileOut string        // tells mage to compile a static binary to this path, but not execute
 	GOOS       string        // sets the GOOS when producing a binary with -compileout
 	GOARCH     string        // sets the GOARCH when producing a binary with -compileout
+	Tags       string        // comma separated build tags to compile the magefiles with
+	Ldflags    string        // flags to pass to the linker when compiling the magefiles
+	Trimpath   bool          // removes file system paths from the compiled binary
+	Race       bool          // compiles the magefiles with the race detector
+	Mod        string        // sets the go tool's -mod flag when compiling the magefiles, e.g. "vendor"
 	Stdout     io.Writer     // writer to write stdout messages to
 	Stderr     io.Writer     // writer to write stderr messages to
 	Stdin      io.Reader     // reader to read stdin from
@@ -135,6 +160,10 @@ func ParseAndRun(stdout, stderr io.Writer, stdin io.Reader, args []string) int {
 		}
 		out.Println(inv.CacheDir, "cleaned")
 		return 0
+	case Graph:
+		return runGraph(inv)
+	case Watch:
+		return runWatch(inv)
 	case CompileStatic:
 		return Invoke(inv)
 	case None:
@@ -156,13 +185,26 @@ func Parse(stderr, stdout io.Writer, args []string) (inv Invocation, cmd Command
 	fs.BoolVar(&inv.Force, "f", false, "force recreation of compiled magefile")
 	fs.BoolVar(&inv.Debug, "debug", mg.Debug(), "turn on debug messages")
 	fs.BoolVar(&inv.Verbose, "v", mg.Verbose(), "show verbose output when running mage targets")
+	fs.IntVar(&inv.Jobs, "j", mg.Jobs(), "run at most N dependencies at once (default: no limit)")
+	fs.BoolVar(&inv.DryRun, "n", mg.DryRun(), "print the targets, dependencies and commands that would run, without running commands")
 	fs.BoolVar(&inv.Help, "h", false, "show this help")
 	fs.DurationVar(&inv.Timeout, "t", 0, "timeout in duration parsable format (e.g. 5m30s)")
+	fs.BoolVar(&inv.Timing, "timing", false, "print how long each target and dependency took when done")
+	fs.StringVar(&inv.Trace, "trace", "", "write a trace of the targets and dependencies run to the given file, in Chrome trace event format")
+	fs.BoolVar(&inv.Prefix, "prefix", mg.Prefix(), "prefix each line of output from commands with the name of the target that ran them")
+	fs.BoolVar(&inv.Buffer, "buffer", mg.Buffer(), "hold the output from commands run by each dependency until it finishes")
 	fs.BoolVar(&inv.Keep, "keep", false, "keep intermediate mage files around after running")
-	fs.StringVar(&inv.Dir, "d", ".", "run magefiles in the given directory")
+	fs.StringVar(&inv.Dir, "d", "", "run magefiles in the given directory")
+	fs.StringVar(&inv.WorkDir, "w", "", "run targets in the given directory (default: the -d directory)")
 	fs.StringVar(&inv.GoCmd, "gocmd", mg.GoCmd(), "use the given go binary to compile the output")
 	fs.StringVar(&inv.GOOS, "goos", "", "set GOOS for binary produced with -compile")
 	fs.StringVar(&inv.GOARCH, "goarch", "", "set GOARCH for binary produced with -compile")
+	fs.BoolVar(&inv.JSON, "json", false, "print the list of targets as JSON (with -l)")
+	fs.StringVar(&inv.Tags, "tags", os.Getenv(TagsEnv), "compile the magefiles with the given comma separated build tags")
+	fs.StringVar(&inv.Ldflags, "ldflags", os.Getenv(LdflagsEnv), "pass the given flags to the linker when compiling the magefiles")
+	fs.BoolVar(&inv.Trimpath, "trimpath", envBool(TrimpathEnv), "remove file system paths from the compiled magefiles")
+	fs.BoolVar(&inv.Race, "race", envBool(RaceEnv), "compile the magefiles with the race detector")
+	fs.StringVar(&inv.Mod, "mod", os.Getenv(ModEnv), "set the go tool's -mod flag when compiling the magefiles")
 
 	// commands below
 
@@ -175,6 +217,10 @@ func Parse(stderr, stdout io.Writer, args []string) (inv Invocation, cmd Command
 	fs.BoolVar(&clean, "clean", false, "clean out old generated binaries from CACHE_DIR")
 	var compileOutPath string
 	fs.StringVar(&compileOutPath, "compile", "", "output a static binary to the given path")
+	var graph bool
+	fs.BoolVar(&graph, "graph", false, "print the dependency graph of the targets")
+	var watch bool
+	fs.BoolVar(&watch, "watch", false, "run the given target, and rerun it when files change")
 
 	fs.Usage = func() {
 		fmt.Fprint(stdout, `
@@ -186,25 +232,55 @@ Commands:
   -clean    clean out old generated binaries from CACHE_DIR
   -compile <string>
             output a static binary to the given path
+  -graph [target]
+            print the dependency graph of all targets, or the given target,
+            in Graphviz DOT format (or JSON with -json)
   -init     create a starting template if no mage files exist
   -l        list mage targets in this directory
   -h        show this help
   -version  show version info for the mage binary
+  -watch <target>
+            run the given target, and rerun it when the magefiles or the
+            files declared for it in the Watch variable change
 
 Options:
+  -buffer   hold the output from commands run by each dependency until it
+            finishes
   -d <string> 
-            run magefiles in the given directory (default ".")
+            run magefiles in the given directory (default: the current
+            directory, or the nearest parent with magefiles)
   -debug    turn on debug messages
   -h        show description of a target
   -f        force recreation of compiled magefile
+  -j <int>  run at most N dependencies at once (default: no limit)
+  -json     print the list of targets from -l or the graph from -graph as JSON
   -keep     keep intermediate mage files around after running
+  -ldflags <string>
+            pass the given flags to the linker when compiling the magefiles
+  -mod <string>
+            set the go tool's -mod flag (e.g. vendor) when compiling the
+            magefiles
+  -n        print the targets, dependencies and commands that would run,
+            without running commands
+  -prefix   prefix each line of output from commands with the name of the
+            target that ran them
+  -race     compile the magefiles with the race detector
   -gocmd <string>
 		    use the given go binary to compile the output (default: "go")
   -goos     sets the GOOS for the binary created by -compile (default: current OS)
   -goarch   sets the GOARCH for the binary created by -compile (default: current arch)
   -t <string>
             timeout in duration parsable format (e.g. 5m30s)
+  -tags <string>
+            compile the magefiles with the given comma separated build tags
+  -timing   print how long each target and dependency took when done
+  -trace <string>
+            write a trace of the targets and dependencies run to the given
+            file, in Chrome trace event format
+  -trimpath remove file system paths from the compiled magefiles
   -v        show verbose output when running mage targets
+  -w <string>
+            run targets in the given directory (default: the -d directory)
 `[1:])
 	}
 	err = fs.Parse(args)
@@ -231,12 +307,18 @@ Options:
 	case showVersion:
 		numCommands++
 		cmd = Version
+	case graph:
+		numCommands++
+		cmd = Graph
+	case watch:
+		numCommands++
+		cmd = Watch
 	case clean:
 		numCommands++
 		cmd = Clean
 		if fs.NArg() > 0 {
 			// Temporary dupe of below check until we refactor the other commands to use this check
-			return inv, cmd, errors.New("-h, -init, -clean, -compile and -version cannot be used simultaneously")
+			return inv, cmd, errors.New("-h, -init, -clean, -compile, -graph, -watch and -version cannot be used simultaneously")
 
 		}
 	}
@@ -252,19 +334,31 @@ Options:
 
 	if numCommands > 1 {
 		debug.Printf("%d commands defined", numCommands)
-		return inv, cmd, errors.New("-h, -init, -clean, -compile and -version cannot be used simultaneously")
+		return inv, cmd, errors.New("-h, -init, -clean, -compile, -graph, -watch and -version cannot be used simultaneously")
 	}
 
 	if cmd != CompileStatic && (inv.GOARCH != "" || inv.GOOS != "") {
 		return inv, cmd, errors.New("-goos and -goarch only apply when running with -compile")
 	}
 
+	if inv.JSON && !inv.List && cmd != Graph {
+		return inv, cmd, errors.New("-json only applies when running with -l or -graph")
+	}
+
 	inv.Args = fs.Args()
 	if inv.Help && len(inv.Args) > 1 {
 		return inv, cmd, errors.New("-h can only show help for a single target")
 	}
 
-	if len(inv.Args) > 0 && cmd != None {
+	if cmd == Graph && len(inv.Args) > 1 {
+		return inv, cmd, errors.New("-graph can only show the graph for a single target")
+	}
+
+	if cmd == Watch && len(inv.Args) == 0 {
+		return inv, cmd, errors.New("-watch requires a target to run")
+	}
+
+	if len(inv.Args) > 0 && cmd != None && cmd != Graph && cmd != Watch {
 		return inv, cmd, fmt.Errorf("unexpected arguments to command: %q", inv.Args)
 	}
 
@@ -273,31 +367,35 @@ Options:
 
 // Invoke runs Mage with the given arguments.
 func Invoke(inv Invocation) int {
+	return invoke(context.Background(), inv)
+}
+
+// invoke runs Mage with the given arguments, stopping the compiled magefile if
+// the context is cancelled.
+func invoke(ctx context.Context, inv Invocation) int {
 	errlog := log.New(inv.Stderr, "", 0)
 	if inv.GoCmd == "" {
 		inv.GoCmd = "go"
 	}
-	if inv.Dir == "" {
-		inv.Dir = "."
-	}
 	if inv.CacheDir == "" {
 		inv.CacheDir = mg.CacheDir()
 	}
 
-	files, err := Magefiles(inv.Dir, inv.GOOS, inv.GOARCH, inv.GoCmd, inv.Stderr, inv.Debug)
+	root, dir, files, err := searchMagefiles(inv)
 	if err != nil {
 		errlog.Println("Error determining list of magefiles:", err)
 		return 1
 	}
+	inv.Dir = root
 
 	if len(files) == 0 {
-		errlog.Println("No .go files marked with the mage build tag in this directory.")
+		errlog.Println(noMagefiles(inv, dir))
 		return 1
 	}
 	debug.Printf("found magefiles: %s", strings.Join(files, ", "))
 	exePath := inv.CompileOut
 	if inv.CompileOut == "" {
-		exePath, err = ExeName(inv.GoCmd, inv.CacheDir, files)
+		exePath, err = ExeNameWithFlags(inv.GoCmd, inv.CacheDir, buildFlags(inv), files)
 		if err != nil {
 			errlog.Println("Error getting exe name:", err)
 			return 1
@@ -305,32 +403,20 @@ func Invoke(inv Invocation) int {
 	}
 	debug.Println("output exe is ", exePath)
 
-	useCache := false
-	if s, err := internal.OutputDebug(inv.GoCmd, "env", "GOCACHE"); err == nil {
-		// if GOCACHE exists, always rebuild, so we catch transitive
-		// dependencies that have changed.
-		if s != "" {
-			debug.Println("build cache exists, will ignore any compiled binary")
-			useCache = true
-		}
-	}
-
-	if !useCache {
-		_, err = os.Stat(exePath)
-		switch {
-		case err == nil:
-			if inv.Force {
-				debug.Println("ignoring existing executable")
-			} else {
-				debug.Println("Running existing exe")
-				return RunCompiled(inv, exePath, errlog)
-			}
-		case os.IsNotExist(err):
-			debug.Println("no existing exe, creating new")
-		default:
-			debug.Printf("error reading existing exe at %v: %v", exePath, err)
-			debug.Println("creating new exe")
+	_, err = os.Stat(exePath)
+	switch {
+	case err == nil:
+		if inv.Force {
+			debug.Println("ignoring existing executable")
+		} else {
+			debug.Println("Running existing exe")
+			return runCompiled(ctx, inv, exePath, errlog)
 		}
+	case os.IsNotExist(err):
+		debug.Println("no existing exe, creating new")
+	default:
+		debug.Printf("error reading existing exe at %v: %v", exePath, err)
+		debug.Println("creating new exe")
 	}
 
 	// parse wants dir + filenames... arg
@@ -342,13 +428,13 @@ func Invoke(inv Invocation) int {
 		parse.EnableDebug()
 	}
 	debug.Println("parsing files")
-	info, err := parse.PrimaryPackage(inv.GoCmd, inv.Dir, fnames)
+	info, err := parse.PrimaryPackage(inv.GoCmd, dir, fnames)
 	if err != nil {
 		errlog.Println("Error parsing magefiles:", err)
 		return 1
 	}
 
-	main := filepath.Join(inv.Dir, mainfile)
+	main := filepath.Join(dir, mainfile)
 	binaryName := "mage"
 	if inv.CompileOut != "" {
 		binaryName = filepath.Base(inv.CompileOut)
@@ -363,7 +449,7 @@ func Invoke(inv Invocation) int {
 		defer os.RemoveAll(main)
 	}
 	files = append(files, main)
-	if err := Compile(inv.GOOS, inv.GOARCH, inv.Dir, inv.GoCmd, exePath, files, inv.Debug, inv.Stderr, inv.Stdout); err != nil {
+	if err := CompileWithFlags(inv.GOOS, inv.GOARCH, buildFlags(inv), dir, inv.GoCmd, exePath, files, inv.Debug, inv.Stderr, inv.Stdout); err != nil {
 		errlog.Println("Error:", err)
 		return 1
 	}
@@ -380,7 +466,7 @@ func Invoke(inv Invocation) int {
 		return 0
 	}
 
-	return RunCompiled(inv, exePath, errlog)
+	return runCompiled(ctx, inv, exePath, errlog)
 }
 
 type mainfileTemplateData struct {
@@ -390,6 +476,189 @@ type mainfileTemplateData struct {
 	Aliases     map[string]*parse.Function
 	Imports     []*parse.Import
 	BinaryName  string
+	ListJSON    string
+}
+
+// listJSON is the output of listing targets with -l -json.
+type listJSON struct {
+	Description string       `json:"description,omitempty"`
+	Targets     []targetJSON `json:"targets"`
+}
+
+// targetJSON describes a single target in the output of -l -json.
+type targetJSON struct {
+	Name       string      `json:"name"`
+	Synopsis   string      `json:"synopsis"`
+	Comment    string      `json:"comment"`
+	Namespace  string      `json:"namespace,omitempty"`
+	ImportPath string      `json:"importPath,omitempty"`
+	Aliases    []string    `json:"aliases,omitempty"`
+	Default    bool        `json:"default"`
+	Context    bool        `json:"context"`
+	Error      bool        `json:"error"`
+	Args       []parse.Arg `json:"args,omitempty"`
+	File       string      `json:"file"`
+	Line       int         `json:"line"`
+}
+
+// makeListJSON returns the JSON listing of all targets in info.  Paths to
+// files in dir are made relative to it.
+func makeListJSON(dir string, info *parse.PkgInfo) (string, error) {
+	list := listJSON{
+		Description: info.Description,
+		Targets:     []targetJSON{},
+	}
+	funcs := info.Funcs
+	for _, imp := range info.Imports {
+		funcs = append(funcs, imp.Info.Funcs...)
+	}
+	for _, f := range funcs {
+		t := targetJSON{
+			Name:       internal.LowerFirst(f.TargetName()),
+			Synopsis:   f.Synopsis,
+			Comment:    f.Comment,
+			Namespace:  f.Receiver,
+			ImportPath: f.ImportPath,
+			Default:    f == info.DefaultFunc,
+			Context:    f.IsContext,
+			Error:      f.IsError,
+			Args:       f.Args,
+			File:       f.File,
+			Line:       f.Line,
+		}
+		if f.ImportPath == "" {
+			if rel, err := filepath.Rel(dir, f.File); err == nil {
+				t.File = rel
+			}
+		}
+		for alias, af := range info.Aliases {
+			if af == f {
+				t.Aliases = append(t.Aliases, alias)
+			}
+		}
+		sort.Strings(t.Aliases)
+		list.Targets = append(list.Targets, t)
+	}
+	sort.Slice(list.Targets, func(i, j int) bool {
+		return list.Targets[i].Name < list.Targets[j].Name
+	})
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// searchMagefiles is like findMagefiles, but if inv.Dir is empty it looks for
+// magefiles in the current directory and then in each of its parents in turn,
+// the way git looks for .git, stopping at the root of the module or of the
+// filesystem.  Root is the directory the magefiles were found in, which is
+// where targets run, or the current directory if there are none.
+func searchMagefiles(inv Invocation) (root, dir string, files []string, err error) {
+	if inv.Dir != "" {
+		dir, files, err = findMagefiles(inv)
+		return inv.Dir, dir, files, err
+	}
+	inv.Dir = "."
+	dir, files, err = findMagefiles(inv)
+	if err != nil || len(files) > 0 {
+		return inv.Dir, dir, files, err
+	}
+	abs, err := filepath.Abs(inv.Dir)
+	if err != nil {
+		return ".", dir, files, err
+	}
+	for parent := inv.Dir; !isModuleRoot(abs); {
+		if filepath.Dir(abs) == abs {
+			break
+		}
+		abs = filepath.Dir(abs)
+		parent = filepath.Join(parent, "..")
+		inv.Dir = parent
+		pdir, pfiles, err := findMagefiles(inv)
+		if err != nil {
+			return ".", dir, files, err
+		}
+		if len(pfiles) > 0 {
+			debug.Println("found magefiles in", parent)
+			return parent, pdir, pfiles, nil
+		}
+	}
+	return ".", dir, files, nil
+}
+
+// isModuleRoot reports whether dir is the root of a go module.
+func isModuleRoot(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, "go.mod"))
+	return err == nil
+}
+
+// findMagefiles returns the directory holding the magefiles for inv, which is
+// the magefiles directory in inv.Dir if there is one, or else inv.Dir, along
+// with the magefiles in it.
+func findMagefiles(inv Invocation) (dir string, files []string, err error) {
+	dir = magefilesDir(inv)
+	if dir == inv.Dir {
+		files, err := Magefiles(inv.Dir, inv.GOOS, inv.GOARCH, inv.GoCmd, inv.Stderr, inv.Debug)
+		return inv.Dir, files, err
+	}
+	debug.Println("using magefiles in", dir)
+	files, err = MagefilesDir(dir, inv.GOOS, inv.GOARCH, inv.GoCmd, inv.Stderr, inv.Debug)
+	return dir, files, err
+}
+
+// magefilesDir returns the directory holding the magefiles for inv, which is
+// the magefiles directory in inv.Dir if there is one, or else inv.Dir.
+func magefilesDir(inv Invocation) string {
+	dir := filepath.Join(inv.Dir, MagefilesDirName)
+	if stat, err := os.Stat(dir); err == nil && stat.IsDir() {
+		return dir
+	}
+	return inv.Dir
+}
+
+// workDir returns the directory the targets for inv run in.
+func workDir(inv Invocation) string {
+	if inv.WorkDir != "" {
+		return inv.WorkDir
+	}
+	return inv.Dir
+}
+
+// noMagefiles returns the message to print when there are no magefiles in dir,
+// as returned by findMagefiles.
+func noMagefiles(inv Invocation, dir string) string {
+	if dir != inv.Dir {
+		return "No .go files found in the " + MagefilesDirName + " directory."
+	}
+	return "No .go files marked with the mage build tag in this directory."
+}
+
+// MagefilesDir returns the list of magefiles in dir, which is a directory
+// holding only magefiles, such as the magefiles directory.  These are all the
+// go files that would be built in dir, with or without the mage build tag.
+func MagefilesDir(dir, goos, goarch, goCmd string, stderr io.Writer, isDebug bool) ([]string, error) {
+	env, err := internal.EnvWithGOOS(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(goCmd, "list", "-tags=mage", "-e", "-f", `{{join .GoFiles "||"}}`)
+	cmd.Env = env
+	if isDebug {
+		cmd.Stderr = stderr
+	}
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mage gofiles: %v", err)
+	}
+	files := []string{}
+	for _, f := range strings.Split(strings.TrimSpace(string(b)), "||") {
+		if f != "" {
+			files = append(files, filepath.Join(dir, f))
+		}
+	}
+	return files, nil
 }
 
 // Magefiles returns the list of magefiles in dir.
@@ -455,8 +724,43 @@ func Magefiles(magePath, goos, goarch, goCmd string, stderr io.Writer, isDebug b
 	return files, nil
 }
 
+// buildFlags returns the flags to pass to the go tool when compiling the
+// magefiles for inv.
+func buildFlags(inv Invocation) []string {
+	var flags []string
+	if inv.Tags != "" {
+		flags = append(flags, "-tags="+inv.Tags)
+	}
+	if inv.Ldflags != "" {
+		flags = append(flags, "-ldflags="+inv.Ldflags)
+	}
+	if inv.Trimpath {
+		flags = append(flags, "-trimpath")
+	}
+	if inv.Race {
+		flags = append(flags, "-race")
+	}
+	if inv.Mod != "" {
+		flags = append(flags, "-mod="+inv.Mod)
+	}
+	return flags
+}
+
+// envBool reports whether the environment variable name is set to a true
+// value, such as "1" or "true".
+func envBool(name string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(name))
+	return b
+}
+
 // Compile uses the go tool to compile the files into an executable at path.
 func Compile(goos, goarch, magePath, goCmd, compileTo string, gofiles []string, isDebug bool, stderr, stdout io.Writer) error {
+	return CompileWithFlags(goos, goarch, nil, magePath, goCmd, compileTo, gofiles, isDebug, stderr, stdout)
+}
+
+// CompileWithFlags is like Compile, but passes flags to go build before the
+// files, such as -tags or -ldflags.
+func CompileWithFlags(goos, goarch string, flags []string, magePath, goCmd, compileTo string, gofiles []string, isDebug bool, stderr, stdout io.Writer) error {
 	debug.Println("compiling to", compileTo)
 	debug.Println("compiling using gocmd:", goCmd)
 	if isDebug {
@@ -471,8 +775,10 @@ func Compile(goos, goarch, magePath, goCmd, compileTo string, gofiles []string,
 	for i := range gofiles {
 		gofiles[i] = filepath.Base(gofiles[i])
 	}
-	debug.Printf("running %s build -o %s %s", goCmd, compileTo, strings.Join(gofiles, " "))
-	c := exec.Command(goCmd, append([]string{"build", "-o", compileTo}, gofiles...)...)
+	args := append([]string{"build", "-o", compileTo}, flags...)
+	args = append(args, gofiles...)
+	debug.Printf("running %s %s", goCmd, strings.Join(args, " "))
+	c := exec.Command(goCmd, args...)
 	c.Env = environ
 	c.Stderr = stderr
 	c.Stdout = stdout
@@ -507,6 +813,11 @@ func GenerateMainfile(binaryName, path string, info *parse.PkgInfo) error {
 		data.DefaultFunc = *info.DefaultFunc
 	}
 
+	data.ListJSON, err = makeListJSON(filepath.Dir(path), info)
+	if err != nil {
+		return fmt.Errorf("error creating target list: %v", err)
+	}
+
 	debug.Println("writing new file at", path)
 	if err := mainfileTemplate.Execute(f, data); err != nil {
 		return fmt.Errorf("can't execute mainfile template: %v", err)
@@ -524,8 +835,16 @@ func GenerateMainfile(binaryName, path string, info *parse.PkgInfo) error {
 }
 
 // ExeName reports the executable filename that this version of Mage would
-// create for the given magefiles.
+// create for the given magefiles.  The name changes whenever anything the
+// binary is built from changes: the magefiles, the packages they import and the
+// modules those come from, or the version of go.
 func ExeName(goCmd, cacheDir string, files []string) (string, error) {
+	return ExeNameWithFlags(goCmd, cacheDir, nil, files)
+}
+
+// ExeNameWithFlags is like ExeName, for magefiles compiled with the given
+// build flags, which change the name too.
+func ExeNameWithFlags(goCmd, cacheDir string, flags, files []string) (string, error) {
 	var hashes []string
 	for _, s := range files {
 		h, err := hashFile(s)
@@ -542,7 +861,11 @@ func ExeName(goCmd, cacheDir string, files []string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	hash := sha1.Sum([]byte(strings.Join(hashes, "") + magicRebuildKey + ver))
+	deps, err := depsHash(goCmd, flags, files)
+	if err != nil {
+		return "", err
+	}
+	hash := sha1.Sum([]byte(strings.Join(hashes, "") + magicRebuildKey + ver + strings.Join(flags, "\x00") + deps))
 	filename := fmt.Sprintf("%x", hash)
 
 	out := filepath.Join(cacheDir, filename)
@@ -583,21 +906,59 @@ func generateInit(dir string) error {
 
 // RunCompiled runs an already-compiled mage command with the given args,
 func RunCompiled(inv Invocation, exePath string, errlog *log.Logger) int {
+	return runCompiled(context.Background(), inv, exePath, errlog)
+}
+
+// runCompiled is like RunCompiled, except that if the context is cancelled, it
+// interrupts the magefile, so that it cancels the context of the running
+// target, and kills it if it doesn't exit within killGrace.
+func runCompiled(ctx context.Context, inv Invocation, exePath string, errlog *log.Logger) int {
 	debug.Println("running binary", exePath)
 	c := exec.Command(exePath, inv.Args...)
 	c.Stderr = inv.Stderr
 	c.Stdout = inv.Stdout
 	c.Stdin = inv.Stdin
-	c.Dir = inv.Dir
+	c.Dir = workDir(inv)
 	// intentionally pass through unaltered os.Environ here.. your magefile has
 	// to deal with it.
 	c.Env = os.Environ()
+	if dir, err := filepath.Abs(magefilesDir(inv)); err == nil {
+		c.Env = append(c.Env, "MAGEFILE_DIR="+dir)
+	}
 	if inv.Verbose {
 		c.Env = append(c.Env, "MAGEFILE_VERBOSE=1")
 	}
+	if inv.DryRun {
+		c.Env = append(c.Env, "MAGEFILE_DRYRUN=1")
+	}
+	if inv.Jobs > 0 {
+		c.Env = append(c.Env, fmt.Sprintf("MAGEFILE_JOBS=%d", inv.Jobs))
+	}
+	if inv.Timing {
+		c.Env = append(c.Env, "MAGEFILE_TIMING=1")
+	}
+	if inv.Prefix {
+		c.Env = append(c.Env, "MAGEFILE_PREFIX=1")
+	}
+	if inv.Buffer {
+		c.Env = append(c.Env, "MAGEFILE_BUFFER=1")
+	}
+	if inv.Trace != "" {
+		// the magefile runs in its working directory, but the path is
+		// relative to where mage was run.
+		trace, err := filepath.Abs(inv.Trace)
+		if err != nil {
+			errlog.Printf("failed to find trace file: %v", err)
+			return 1
+		}
+		c.Env = append(c.Env, "MAGEFILE_TRACE="+trace)
+	}
 	if inv.List {
 		c.Env = append(c.Env, "MAGEFILE_LIST=1")
 	}
+	if inv.JSON {
+		c.Env = append(c.Env, "MAGEFILE_JSON=1")
+	}
 	if inv.Help {
 		c.Env = append(c.Env, "MAGEFILE_HELP=1")
 	}
@@ -608,7 +969,29 @@ func RunCompiled(inv Invocation, exePath string, errlog *log.Logger) int {
 		c.Env = append(c.Env, fmt.Sprintf("MAGEFILE_TIMEOUT=%s", inv.Timeout.String()))
 	}
 	debug.Print("running magefile with mage vars:\n", strings.Join(filter(c.Env, "MAGEFILE"), "\n"))
-	err := c.Run()
+	if ctx.Done() != nil {
+		// run the magefile in its own process group, so it can be stopped
+		// along with any commands it is running.
+		internal.SetProcessGroup(c)
+	}
+	err := c.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- c.Wait() }()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			debug.Println("interrupting magefile")
+			internal.InterruptProcessGroup(c)
+			select {
+			case err = <-done:
+			case <-time.After(killGrace):
+				debug.Println("killing magefile")
+				internal.KillProcessGroup(c)
+				err = <-done
+			}
+		}
+	}
 	if !sh.CmdRan(err) {
 		errlog.Printf("failed to run compiled magefile: %v", err)
 	}
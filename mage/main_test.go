@@ -2,8 +2,10 @@ package mage
 
 import (
 	"bytes"
+	"context"
 	"debug/macho"
 	"debug/pe"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"go/build"
@@ -523,6 +525,116 @@ func TestHashTemplate(t *testing.T) {
 	}
 }
 
+func TestHashBuildFlags(t *testing.T) {
+	files := []string{"testdata/func.go", "testdata/command.go"}
+	name, err := ExeName("go", mg.CacheDir(), files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := ExeNameWithFlags("go", mg.CacheDir(), []string{"-tags=foo"}, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged == name {
+		t.Fatal("expected executable name to change if build flags changed")
+	}
+}
+
+// ensure the executable name changes when a package the magefiles import, or
+// the module they are in, changes, and only then.
+func TestHashDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module example.com/deps\n")
+	write("magefile.go", "//+build mage\n\npackage main\n\nimport \"example.com/deps/helper\"\n\nfunc Build() { helper.Help() }\n")
+	write("helper/helper.go", "package helper\n\nimport _ \"embed\"\n\n//go:embed data.txt\nvar data string\n\nfunc Help() {}\n")
+	write("helper/data.txt", "data")
+	files := []string{filepath.Join(dir, "magefile.go")}
+	exeName := func() string {
+		name, err := ExeName("go", mg.CacheDir(), files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+
+	name := exeName()
+	if same := exeName(); same != name {
+		t.Fatalf("expected executable name to stay the same, but it changed from %q to %q", name, same)
+	}
+	write("helper/helper.go", "package helper\n\nimport _ \"embed\"\n\n//go:embed data.txt\nvar data string\n\nfunc Help() { println() }\n")
+	helper := exeName()
+	if helper == name {
+		t.Fatal("expected executable name to change if an imported package changed")
+	}
+	write("go.sum", "example.com/other v1.0.0 h1:abc=\n")
+	sum := exeName()
+	if sum == helper {
+		t.Fatal("expected executable name to change if go.sum changed")
+	}
+	write("helper/data.txt", "changed")
+	if embedded := exeName(); embedded == sum {
+		t.Fatal("expected executable name to change if an embedded file changed")
+	}
+}
+
+func TestLdflags(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:     "./testdata/buildflags",
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Ldflags: "-X main.version=1.2.3",
+		Args:    []string{"version"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "1.2.3\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+
+	// the binary compiled without the flag must not be the one compiled with it.
+	stdout.Reset()
+	inv.Ldflags = ""
+	code = Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected = "dev\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+}
+
+func TestParseBuildFlags(t *testing.T) {
+	defer os.Setenv(RaceEnv, os.Getenv(RaceEnv))
+	os.Setenv(RaceEnv, "1")
+	inv, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-tags", "a,b", "-ldflags", "-s -w", "-trimpath", "-mod", "vendor", "build"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	expected := []string{"-tags=a,b", "-ldflags=-s -w", "-trimpath", "-race", "-mod=vendor"}
+	if flags := buildFlags(inv); !reflect.DeepEqual(flags, expected) {
+		t.Fatalf("expected build flags %q, but got %q", expected, flags)
+	}
+}
+
 // Test if the -keep flag does keep the mainfile around after running
 func TestKeepFlag(t *testing.T) {
 	buildFile := fmt.Sprintf("./testdata/keep_flag/%s", mainfile)
@@ -750,6 +862,39 @@ func TestTimeout(t *testing.T) {
 		t.Fatalf("expected %q, but got %q", expected, actual)
 	}
 }
+
+func TestTimeoutStopsCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stopped := filepath.Join(dir, "not_stopped")
+	os.Setenv("STOPPED_FILE", stopped)
+	defer os.Unsetenv("STOPPED_FILE")
+
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:     "testdata/context",
+		Stdout:  ioutil.Discard,
+		Stderr:  stderr,
+		Args:    []string{"command"},
+		Timeout: 500 * time.Millisecond,
+	}
+	code := Invoke(inv)
+	if code != 1 {
+		t.Fatalf("expected 1, but got %v, stderr: %q", code, stderr)
+	}
+	// the command would have touched the file by now if it was still running.
+	time.Sleep(3 * time.Second)
+	if _, err := os.Stat(stopped); err == nil {
+		t.Fatal("expected command to be stopped when the timeout ran out")
+	}
+}
+
 func TestParseHelp(t *testing.T) {
 	buf := &bytes.Buffer{}
 	_, _, err := Parse(ioutil.Discard, buf, []string{"-h"})
@@ -1311,3 +1456,691 @@ func fileData(file string) (exeType, archSize, error) {
 	}
 	return -1, -1, fmt.Errorf("unrecognized executable format")
 }
+
+func TestArgs(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stderr: stderr,
+		Stdout: stdout,
+		Args:   []string{"status", "deploy", "prod", "3", "true", "wait", "1m30s", "0.5", "status"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "status\ndeploy prod 3 true\nwait 1m30s 0.5\nstatus\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout.String())
+	}
+}
+
+func TestArgsMissing(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stderr: stderr,
+		Stdout: stdout,
+		Args:   []string{"status", "deploy", "prod"},
+	}
+	code := Invoke(inv)
+	if code != 2 {
+		t.Fatalf("expected 2, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "not enough arguments for target \"deploy\", expected 3, got 1\n"
+	if stderr.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stderr.String())
+	}
+	if stdout.String() != "" {
+		t.Fatalf("expected no targets to run, but got %q", stdout.String())
+	}
+}
+
+func TestArgsBadValue(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stderr: stderr,
+		Stdout: stdout,
+		Args:   []string{"deploy", "prod", "three", "true"},
+	}
+	code := Invoke(inv)
+	if code != 2 {
+		t.Fatalf("expected 2, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "invalid value \"three\" for argument <replicas> of target \"Deploy\": expected int\n"
+	if stderr.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stderr.String())
+	}
+}
+
+func TestHelpArgs(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stdout: stdout,
+		Stderr: ioutil.Discard,
+		Args:   []string{"deploy"},
+		Help:   true,
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Errorf("expected to exit with code 0, but got %v", code)
+	}
+	actual := stdout.String()
+	expected := "mage deploy:\n\nDeploys the given environment.\n\nUsage:\n\n\tmage deploy <env> <replicas> <dryRun>\n\n"
+	if actual != expected {
+		t.Fatalf("expected %q, but got %q", expected, actual)
+	}
+}
+
+func TestTargetFlags(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stderr: stderr,
+		Stdout: stdout,
+		Args:   []string{"test", "-race", "-count=3", "-pkg", "./api/...", "release", "-sign", "v1.0.0", "test", "status"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "test true 3 ./api/... 10m0s\nrelease v1.0.0 true\ntest false 1 ./... 10m0s\nstatus\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout.String())
+	}
+}
+
+func TestTargetFlagsUnknown(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stderr: stderr,
+		Stdout: stdout,
+		Args:   []string{"status", "test", "-nope"},
+	}
+	code := Invoke(inv)
+	if code != 2 {
+		t.Fatalf("expected 2, but got %v, stderr:\n%s", code, stderr)
+	}
+	if !strings.Contains(stderr.String(), "flag provided but not defined: -nope") {
+		t.Fatalf("expected error about undefined flag, but got %q", stderr)
+	}
+	if stdout.String() != "" {
+		t.Fatalf("expected no targets to run, but got %q", stdout.String())
+	}
+}
+
+func TestHelpTargetFlags(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/args",
+		Stdout: stdout,
+		Stderr: ioutil.Discard,
+		Args:   []string{"test"},
+		Help:   true,
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Errorf("expected to exit with code 0, but got %v", code)
+	}
+	actual := stdout.String()
+	expected := `
+mage test:
+
+Runs the tests.
+
+Usage:
+
+	mage test [options]
+
+Options:
+  -count int
+    	number of times to run each test (default 1)
+  -pkg string
+    	packages to test (default "./...")
+  -race
+    	run tests with the race detector
+  -timeout duration
+    	 (default 10m0s)
+
+`[1:]
+	if actual != expected {
+		t.Fatalf("expected %q, but got %q", expected, actual)
+	}
+}
+
+func TestListJSON(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/list",
+		Stdout: stdout,
+		Stderr: stderr,
+		List:   true,
+		JSON:   true,
+	}
+
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	var actual listJSON
+	if err := json.Unmarshal(stdout.Bytes(), &actual); err != nil {
+		t.Fatalf("error parsing output %q: %v", stdout, err)
+	}
+	expected := listJSON{
+		Description: "This is a comment on the package which should get turned into output with the list of targets.",
+		Targets: []targetJSON{
+			{
+				Name:     "somePig",
+				Synopsis: "This is the synopsis for SomePig.",
+				Comment:  "This is the synopsis for SomePig.  There's more data that won't show up.",
+				Default:  true,
+				File:     "command.go",
+				Line:     27,
+			},
+			{
+				Name: "testVerbose",
+				File: "command.go",
+				Line: 22,
+			},
+		},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected:\n%#v\n\ngot:\n%#v", expected, actual)
+	}
+}
+
+func TestListJSONAliases(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/alias",
+		Stdout: stdout,
+		Stderr: stderr,
+		List:   true,
+		JSON:   true,
+	}
+
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	var actual listJSON
+	if err := json.Unmarshal(stdout.Bytes(), &actual); err != nil {
+		t.Fatalf("error parsing output %q: %v", stdout, err)
+	}
+	aliases := map[string][]string{}
+	for _, target := range actual.Targets {
+		aliases[target.Name] = target.Aliases
+	}
+	expected := map[string][]string{
+		"checkout": {"co"},
+		"status":   {"st", "stat"},
+	}
+	if !reflect.DeepEqual(aliases, expected) {
+		t.Fatalf("expected aliases %q but got %q", expected, aliases)
+	}
+}
+
+func TestParseJSONWithoutList(t *testing.T) {
+	_, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-json"})
+	if err == nil {
+		t.Fatal("expected error using -json without -l")
+	}
+}
+
+func TestGraphDOT(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := ParseAndRun(stdout, stderr, nil, []string{"-d", "testdata/graph", "-graph"})
+	if code != 0 {
+		t.Fatalf("expected 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := `
+digraph mage {
+	"build" [shape=box];
+	"buildFor" [shape=ellipse];
+	"download" [shape=ellipse];
+	"generate" [shape=box];
+	"nS:lint" [shape=box];
+	"release" [shape=box];
+	"tools" [shape=ellipse];
+	"build" -> "generate";
+	"build" -> "nS:lint";
+	"build" -> "buildFor" [label="(\"linux\")"];
+	"build" -> "download";
+	"buildFor" -> "tools";
+	"generate" -> "tools" [label="1"];
+	"generate" -> "download" [label="2"];
+	"unresolved 1" [label="deps", style=dashed, color=red];
+	"release" -> "unresolved 1" [style=dashed, color=red];
+	"unresolved 2" [label="(func() literal)", style=dashed, color=red];
+	"release" -> "unresolved 2" [style=dashed, color=red];
+	"unresolved 3" [label="build", style=dashed, color=red];
+	"release" -> "unresolved 3" [style=dashed, color=red];
+}
+`[1:]
+	if actual := stdout.String(); actual != expected {
+		t.Fatalf("expected:\n%s\n\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestGraphTargetJSON(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := ParseAndRun(stdout, stderr, nil, []string{"-d", "testdata/graph", "-graph", "-json", "B"})
+	if code != 0 {
+		t.Fatalf("expected 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	var g struct {
+		Nodes []struct {
+			Name string
+		}
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &g); err != nil {
+		t.Fatalf("error parsing output %q: %v", stdout, err)
+	}
+	var names []string
+	for _, n := range g.Nodes {
+		names = append(names, n.Name)
+	}
+	expected := []string{"build", "buildFor", "download", "generate", "nS:lint", "tools"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected nodes %q but got %q", expected, names)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/dryrun",
+		Stdout: stdout,
+		Stderr: stderr,
+		DryRun: true,
+		Args:   []string{"build"},
+	}
+
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := `target: Build
+dep: Generate
+exec: thiswontwork generate ./...
+dep: Clean
+rm: bin
+exec: GOOS=linux thiswontwork build -o "bin/my app"
+`
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+}
+
+func TestParseDryRun(t *testing.T) {
+	inv, cmd, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-n", "build"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if cmd != None {
+		t.Errorf("Expected 'none' command but got %v", cmd)
+	}
+	if !inv.DryRun {
+		t.Error("expected DryRun to be true")
+	}
+}
+
+func TestParseJobs(t *testing.T) {
+	inv, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-j", "4", "build"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if inv.Jobs != 4 {
+		t.Errorf("expected Jobs to be 4, but got %v", inv.Jobs)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	trace := filepath.Join(dir, "trace.json")
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/trace",
+		Stdout: stdout,
+		Stderr: stderr,
+		Trace:  trace,
+		Args:   []string{"build", "fail"},
+	}
+
+	code := Invoke(inv)
+	if code != 1 {
+		t.Fatalf("expected to exit with code 1, but got %v, stderr:\n%s", code, stderr)
+	}
+	b, err := ioutil.ReadFile(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []struct {
+		Name string            `json:"name"`
+		Cat  string            `json:"cat"`
+		Ph   string            `json:"ph"`
+		Ts   int64             `json:"ts"`
+		Dur  int64             `json:"dur"`
+		Args map[string]string `json:"args"`
+	}
+	if err := json.Unmarshal(b, &events); err != nil {
+		t.Fatalf("error parsing trace %q: %v", b, err)
+	}
+	actual := map[string]string{}
+	for _, e := range events {
+		if e.Ph != "X" {
+			t.Errorf("expected complete event for %s, but got phase %q", e.Name, e.Ph)
+		}
+		if e.Ts < 0 || e.Dur < 0 {
+			t.Errorf("expected non-negative times for %s, but got ts %v, dur %v", e.Name, e.Ts, e.Dur)
+		}
+		actual[e.Name] = e.Cat + " " + e.Args["error"]
+	}
+	expected := map[string]string{
+		"Build":    "target ",
+		"Generate": "dependency ",
+		"Lint":     "dependency ",
+		"Fail":     "target oops",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected events %v, but got %v", expected, actual)
+	}
+}
+
+func TestTiming(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/trace",
+		Stdout: stdout,
+		Stderr: stderr,
+		Timing: true,
+		Args:   []string{"build"},
+	}
+
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	out := stderr.String()
+	for _, s := range []string{"Timing:", "NAME", "Build", "Generate", "Lint", "Most dependencies running at once: 2"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected timing report to contain %q, but got:\n%s", s, out)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/prefix",
+		Stdout: stdout,
+		Stderr: stderr,
+		Prefix: true,
+		Buffer: true,
+		Args:   []string{"build"},
+	}
+
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	out := stdout.String()
+	for _, s := range []string{"[Generate] generating\n[Generate] more generating\n", "[Lint] linting\n", "[Build] building\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("expected output to contain %q, but got:\n%s", s, out)
+		}
+	}
+	if !strings.HasSuffix(out, "[Build] building\n") {
+		t.Errorf("expected the target's output after its dependencies', but got:\n%s", out)
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	inv, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-prefix", "-buffer", "build"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if !inv.Prefix || !inv.Buffer {
+		t.Errorf("expected Prefix and Buffer to be true, but got %v and %v", inv.Prefix, inv.Buffer)
+	}
+}
+
+func TestMagefilesDir(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/magefiles_dir",
+		Stdout: stdout,
+		Stderr: stderr,
+		Args:   []string{"where"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	// the target runs in the directory mage was run in, not the magefiles
+	// directory.
+	expected := "magefiles_dir from helper.go\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+	if _, err := os.Stat(filepath.Join(inv.Dir, MagefilesDirName, mainfile)); !os.IsNotExist(err) {
+		t.Fatalf("expected mainfile to be removed, but got %v", err)
+	}
+}
+
+func TestMagefilesDirList(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    "./testdata/magefiles_dir",
+		Stdout: stdout,
+		Stderr: ioutil.Discard,
+		List:   true,
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v", code)
+	}
+	expected := "Targets:\n  where    Prints the directory the target runs in.\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+}
+
+// chdir changes the working directory to dir, and returns a function that
+// changes it back.
+func chdir(t *testing.T, dir string) (restore func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSearchParentDirs(t *testing.T) {
+	defer chdir(t, "./testdata/parentdir/sub")()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Stdout: stdout,
+		Stderr: stderr,
+		Args:   []string{"where"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "parentdir\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+}
+
+func TestSearchStopsAtModuleRoot(t *testing.T) {
+	defer chdir(t, "./testdata/parentdir/module/sub")()
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Stdout: ioutil.Discard,
+		Stderr: stderr,
+		Args:   []string{"where"},
+	}
+	code := Invoke(inv)
+	if code != 1 {
+		t.Fatalf("expected to exit with code 1, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "No .go files marked with the mage build tag in this directory.\n"
+	if stderr.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stderr)
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:     "./testdata/workdir",
+		WorkDir: "./testdata/setdir",
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Args:    []string{"where"},
+	}
+	code := Invoke(inv)
+	if code != 0 {
+		t.Fatalf("expected to exit with code 0, but got %v, stderr:\n%s", code, stderr)
+	}
+	expected := "setdir workdir\n"
+	if stdout.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, stdout)
+	}
+}
+
+func TestParseWorkDir(t *testing.T) {
+	inv, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-d", "build/mage", "-w", "..", "build"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if inv.Dir != "build/mage" || inv.WorkDir != ".." {
+		t.Errorf("expected Dir build/mage and WorkDir .., but got %q and %q", inv.Dir, inv.WorkDir)
+	}
+}
+
+func TestParseWatchWithoutTarget(t *testing.T) {
+	_, _, err := Parse(ioutil.Discard, ioutil.Discard, []string{"-watch"})
+	expected := "-watch requires a target to run"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, but got %v", expected, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"go.mod": "module watchtest\n",
+		"magefile.go": `//+build mage
+
+package main
+
+import "os"
+
+var Watch = map[string][]string{
+	"count": {"src/*.txt"},
+}
+
+// Appends to runs.txt each time it runs.
+func Count() error {
+	f, err := os.OpenFile("runs.txt", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString("x")
+	return err
+}
+`,
+		"src/a.txt": "a",
+	}
+	for name, contents := range files {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defaultInterval, defaultDebounce := watchInterval, watchDebounce
+	watchInterval, watchDebounce = 50*time.Millisecond, 50*time.Millisecond
+	defer func() { watchInterval, watchDebounce = defaultInterval, defaultDebounce }()
+
+	stderr := &bytes.Buffer{}
+	inv := Invocation{
+		Dir:    dir,
+		Stdout: ioutil.Discard,
+		Stderr: stderr,
+		Args:   []string{"count"},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() { done <- watch(ctx, inv) }()
+
+	waitForRuns := func(n int) {
+		for start := time.Now(); time.Since(start) < time.Minute; time.Sleep(50 * time.Millisecond) {
+			b, _ := ioutil.ReadFile(filepath.Join(dir, "runs.txt"))
+			if len(b) == n {
+				return
+			}
+		}
+		cancel()
+		<-done
+		t.Fatalf("timed out waiting for target to run %d times, stderr:\n%s", n, stderr)
+	}
+	waitForRuns(1)
+	// unwatched files don't cause the target to rerun
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("ab"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForRuns(2)
+	cancel()
+	if code := <-done; code != 0 {
+		t.Fatalf("expected watch to exit with code 0, but got %v", code)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "runs.txt"))
+	if string(b) != "xx" {
+		t.Fatalf("expected target to run twice, but got %q", b)
+	}
+}
@@ -9,15 +9,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 	{{range .Imports}}{{.UniqueName}} "{{.Path}}"
@@ -28,7 +31,14 @@ func main() {
 	// Use local types and functions in order to avoid name conflicts with additional magefiles.
 	type arguments struct {
 		Verbose       bool          // print out log statements
+		DryRun        bool          // print what would run instead of running commands
+		Jobs          int           // the maximum number of dependencies to run at once
+		Timing        bool          // print how long each target and dependency took
+		Trace         string        // write a trace of the targets and dependencies to this file
+		Prefix        bool          // prefix each line of command output with the target's name
+		Buffer        bool          // write the command output of each dependency when it finishes
 		List          bool          // print out a list of targets
+		JSON          bool          // print the list of targets as JSON
 		Help          bool          // print out help for a specific target
 		Timeout       time.Duration // set a timeout to running the targets
 		Args          []string      // args contain the non-flag command-line arguments
@@ -47,6 +57,19 @@ func main() {
 		return b
 	}
 
+	parseInt := func(env string) int {
+		val := os.Getenv(env)
+		if val == "" {
+			return 0
+		}
+		i, err := strconv.Atoi(val)
+		if err != nil {
+			log.Printf("warning: environment variable %s is not a valid int value: %v", env, val)
+			return 0
+		}
+		return i
+	}
+
 	parseDuration := func(env string) time.Duration {
 		val := os.Getenv(env)
 		if val == "" {
@@ -65,7 +88,14 @@ func main() {
 
 	// default flag set with ExitOnError and auto generated PrintDefaults should be sufficient
 	fs.BoolVar(&args.Verbose, "v", parseBool("MAGEFILE_VERBOSE"), "show verbose output when running targets")
+	fs.IntVar(&args.Jobs, "j", parseInt("MAGEFILE_JOBS"), "run at most N dependencies at once (default: no limit)")
+	fs.BoolVar(&args.DryRun, "n", parseBool("MAGEFILE_DRYRUN"), "print the targets, dependencies and commands that would run, without running commands")
+	fs.BoolVar(&args.Timing, "timing", parseBool("MAGEFILE_TIMING"), "print how long each target and dependency took when done")
+	fs.StringVar(&args.Trace, "trace", os.Getenv("MAGEFILE_TRACE"), "write a trace of the targets and dependencies run to the given file, in Chrome trace event format")
+	fs.BoolVar(&args.Prefix, "prefix", parseBool("MAGEFILE_PREFIX"), "prefix each line of output from commands with the name of the target that ran them")
+	fs.BoolVar(&args.Buffer, "buffer", parseBool("MAGEFILE_BUFFER"), "hold the output from commands run by each dependency until it finishes")
 	fs.BoolVar(&args.List, "l", parseBool("MAGEFILE_LIST"), "list targets for this binary")
+	fs.BoolVar(&args.JSON, "json", parseBool("MAGEFILE_JSON"), "print the list of targets as JSON (with -l)")
 	fs.BoolVar(&args.Help, "h", parseBool("MAGEFILE_HELP"), "print out help for a specific target")
 	fs.DurationVar(&args.Timeout, "t", parseDuration("MAGEFILE_TIMEOUT"), "timeout in duration parsable format (e.g. 5m30s)")
 	fs.Usage = func() {
@@ -77,9 +107,25 @@ Commands:
   -h    show this help
 
 Options:
+  -buffer
+        hold the output from commands run by each dependency until it
+        finishes
   -h    show description of a target
+  -j <int>
+        run at most N dependencies at once (default: no limit)
+  -json print the list of targets from -l as JSON
+  -n    print the targets, dependencies and commands that would run,
+        without running commands
+  -prefix
+        prefix each line of output from commands with the name of the
+        target that ran them
   -t <string>
         timeout in duration parsable format (e.g. 5m30s)
+  -timing
+        print how long each target and dependency took when done
+  -trace <string>
+        write a trace of the targets and dependencies run to the given file,
+        in Chrome trace event format
   -v    show verbose output when running targets
  ` + "`" + `[1:], filepath.Base(os.Args[0]))
 	}
@@ -88,12 +134,32 @@ Options:
 		return
 	}
 	args.Args = fs.Args()
+	if args.DryRun {
+		// let the mg and sh packages know, in case -n was passed directly.
+		os.Setenv("MAGEFILE_DRYRUN", "1")
+	}
+	if args.Jobs > 0 {
+		// let the mg package know, in case -j was passed directly.
+		os.Setenv("MAGEFILE_JOBS", strconv.Itoa(args.Jobs))
+	}
+	if args.Prefix {
+		// let the sh package know, in case -prefix was passed directly.
+		os.Setenv("MAGEFILE_PREFIX", "1")
+	}
+	if args.Buffer {
+		// let the mg and sh packages know, in case -buffer was passed directly.
+		os.Setenv("MAGEFILE_BUFFER", "1")
+	}
 	if args.Help && len(args.Args) == 0 {
 		fs.Usage()
 		return
 	}
 	  
 	list := func() error {
+		if args.JSON {
+			_, err := fmt.Println({{printf "%q" .ListJSON}})
+			return err
+		}
 		{{with .Description}}fmt.Println(` + "`{{.}}\n`" + `)
 		{{- end}}
 		{{- $default := .DefaultFunc}}
@@ -128,6 +194,133 @@ Options:
 		return err
 	}
 
+	// traceEvent is a complete event in the Chrome trace event format.
+	type traceEvent struct {
+		Name string            ` + "`json:\"name\"`" + `
+		Cat  string            ` + "`json:\"cat\"`" + `
+		Ph   string            ` + "`json:\"ph\"`" + `
+		Ts   int64             ` + "`json:\"ts\"`" + `
+		Dur  int64             ` + "`json:\"dur\"`" + `
+		Pid  int               ` + "`json:\"pid\"`" + `
+		Tid  int64             ` + "`json:\"tid\"`" + `
+		Args map[string]string ` + "`json:\"args,omitempty\"`" + `
+	}
+	var traceEvents []traceEvent
+	traceStart := time.Now()
+	// the mg package records how long dependencies take in traceFile, since
+	// the magefiles might not import it, so it can't be asked for them
+	// directly.  It's given the descriptor of the file along with this
+	// process's ID, so that commands that inherit the variable ignore it, and
+	// the file is removed straight away where open files can be, so that it
+	// isn't left behind if mage is killed.
+	var traceFile *os.File
+	os.Unsetenv("MAGEFILE_TRACE_EVENTS")
+	if args.Timing || args.Trace != "" {
+		f, err := ioutil.TempFile("", "mage-trace-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error recording dependency timing:", err)
+		} else {
+			traceFile = f
+			os.Remove(f.Name())
+			os.Setenv("MAGEFILE_TRACE_EVENTS", fmt.Sprintf("%d:%d", os.Getpid(), f.Fd()))
+		}
+	}
+
+	recordTarget := func(name string, start time.Time, err interface{}) {
+		if !args.Timing && args.Trace == "" {
+			return
+		}
+		e := traceEvent{
+			Name: name,
+			Cat:  "target",
+			Ph:   "X",
+			Ts:   start.UnixNano() / int64(time.Microsecond),
+			Dur:  int64(time.Since(start) / time.Microsecond),
+			Pid:  os.Getpid(),
+		}
+		if err != nil {
+			e.Args = map[string]string{"error": fmt.Sprint(err)}
+		}
+		traceEvents = append(traceEvents, e)
+	}
+
+	writeTrace := func() {
+		if !args.Timing && args.Trace == "" {
+			return
+		}
+		events := traceEvents
+		if traceFile != nil {
+			traceFile.Seek(0, 0)
+			if b, err := ioutil.ReadAll(traceFile); err == nil {
+				for _, line := range strings.Split(string(b), "\n") {
+					var e traceEvent
+					if json.Unmarshal([]byte(line), &e) == nil {
+						events = append(events, e)
+					}
+				}
+			}
+			traceFile.Close()
+			// where the file couldn't be removed while it was open.
+			os.Remove(traceFile.Name())
+			traceFile = nil
+		}
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Ts < events[j].Ts })
+		start := traceStart.UnixNano() / int64(time.Microsecond)
+		for i := range events {
+			events[i].Ts -= start
+		}
+
+		if args.Trace != "" {
+			b, err := json.MarshalIndent(events, "", "  ")
+			if err == nil {
+				err = ioutil.WriteFile(args.Trace, b, 0644)
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing trace:", err)
+			}
+		}
+		if args.Timing {
+			// count the most dependencies running at once, finishing any that
+			// end at the same time others start first.
+			type point struct {
+				t     int64
+				delta int
+			}
+			var points []point
+			for _, e := range events {
+				if e.Cat == "dependency" {
+					points = append(points, point{e.Ts, 1}, point{e.Ts + e.Dur, -1})
+				}
+			}
+			sort.Slice(points, func(i, j int) bool {
+				if points[i].t != points[j].t {
+					return points[i].t < points[j].t
+				}
+				return points[i].delta < points[j].delta
+			})
+			running, most := 0, 0
+			for _, p := range points {
+				running += p.delta
+				if running > most {
+					most = running
+				}
+			}
+
+			fmt.Fprintln(os.Stderr, "Timing:")
+			w := tabwriter.NewWriter(os.Stderr, 0, 4, 4, ' ', 0)
+			fmt.Fprintln(w, "  NAME\tKIND\tSTART\tDURATION\tRESULT")
+			for _, e := range events {
+				result := "ok"
+				if _, ok := e.Args["error"]; ok {
+					result = "error"
+				}
+				fmt.Fprintf(w, "  %s\t%s\t%v\t%v\t%s\n", e.Name, e.Cat, time.Duration(e.Ts)*time.Microsecond, time.Duration(e.Dur)*time.Microsecond, result)
+			}
+			w.Flush()
+			fmt.Fprintln(os.Stderr, "Most dependencies running at once:", most)
+		}
+	}
+
 	var ctx context.Context
 	var ctxCancel func()
 
@@ -145,10 +338,40 @@ Options:
 		return ctx, ctxCancel
 	}
 
-	runTarget := func(fn func(context.Context) error) interface{} {
-		var err interface{}
+	// interrupted receives a signal when mage is interrupted or terminated,
+	// for example by mage -watch restarting the target, so the running
+	// target's context can be cancelled.  It's only notified while a target
+	// that takes a context is running, since other targets can't be stopped
+	// that way, and are left to exit when interrupted.
+	interrupted := make(chan os.Signal, 1)
+
+	// stopTarget cancels the running target's context, and waits for it to
+	// return, so that commands run with the context (see sh.RunCtx) are
+	// stopped before mage exits.  The target is given long enough for the
+	// commands to be killed if they don't exit when asked, and another
+	// interrupt stops waiting.
+	stopTarget := func(stop func(), d chan interface{}) {
+		stop()
+		select {
+		case <-d:
+		case <-interrupted:
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	runTarget := func(name string, isContext bool, fn func(context.Context) error) (err interface{}) {
+		start := time.Now()
+		defer func() { recordTarget(name, start, err) }()
+		if isContext {
+			signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(interrupted)
+		}
+		// the sh package prefixes output with this name when run with -prefix.
+		os.Setenv("MAGEFILE_TARGET", name)
 		ctx, cancel := getContext()
-		d := make(chan interface{})
+		ctx, stop := context.WithCancel(ctx)
+		defer stop()
+		d := make(chan interface{}, 2)
 		go func() {
 			defer func() {
 				err := recover()
@@ -162,7 +385,12 @@ Options:
 			cancel()
 			e := ctx.Err()
 			fmt.Printf("ctx err: %v\n", e)
+			stopTarget(stop, d)
 			return e
+		case <-interrupted:
+			stopTarget(stop, d)
+			cancel()
+			return fmt.Errorf("interrupted")
 		case err = <-d:
 			cancel()
 			return err
@@ -175,6 +403,7 @@ Options:
 	handleError := func(logger *log.Logger, err interface{}) {
 		if err != nil {
 			logger.Printf("Error: %v\n", err)
+			writeTrace()
 			type code interface {
 				ExitStatus() int
 			}
@@ -199,25 +428,52 @@ Options:
 		return
 	}
 
-	targets := map[string]bool {
-		{{range $alias, $funci := .Aliases}}"{{lower $alias}}": true,
+	// targets maps each target and alias to the number of arguments it takes.
+	targets := map[string]int {
+		{{range $alias, $funci := .Aliases}}"{{lower $alias}}": {{len $funci.Args}},
 		{{end}}
-		{{range .Funcs}}"{{lower .TargetName}}": true,
+		{{range .Funcs}}"{{lower .TargetName}}": {{len .Args}},
 		{{end}}
 		{{range .Imports}}
 			{{$imp := .}}
-			{{range $alias, $funci := .Info.Aliases}}"{{if ne $imp.Alias "."}}{{lower $imp.Alias}}:{{end}}{{lower $alias}}": true,
+			{{range $alias, $funci := .Info.Aliases}}"{{if ne $imp.Alias "."}}{{lower $imp.Alias}}:{{end}}{{lower $alias}}": {{len $funci.Args}},
 			{{end}}
-			{{range .Info.Funcs}}"{{lower .TargetName}}": true,
+			{{range .Info.Funcs}}"{{lower .TargetName}}": {{len .Args}},
 			{{end}}
 		{{end}}
 	}
 
+	// targetFlags creates the flag sets for targets that take options.
+	targetFlags := map[string]func() (*flag.FlagSet, func() interface{}) {
+		{{range $alias, $funci := .Aliases}}{{if $funci.Options}}"{{lower $alias}}": {{$funci.FlagsCode}},
+		{{end}}{{end}}
+		{{range .Funcs}}{{if .Options}}"{{lower .TargetName}}": {{.FlagsCode}},
+		{{end}}{{end}}
+		{{range .Imports}}
+			{{range .Info.Funcs}}{{if .Options}}"{{lower .TargetName}}": {{.FlagsCode}},
+			{{end}}{{end}}
+		{{end}}
+	}
+
 	var unknown []string
-	for _, arg := range args.Args {
-		if !targets[strings.ToLower(arg)] {
-			unknown = append(unknown, arg)
+	for x := 0; x < len(args.Args); {
+		target := args.Args[x]
+		x++
+		n, ok := targets[strings.ToLower(target)]
+		if !ok {
+			unknown = append(unknown, target)
+			continue
 		}
+		if newFlags, ok := targetFlags[strings.ToLower(target)]; ok && !args.Help {
+			fs, _ := newFlags()
+			fs.Parse(args.Args[x:])
+			x = len(args.Args) - fs.NArg()
+		}
+		if !args.Help && x+n > len(args.Args) {
+			logger.Printf("not enough arguments for target %q, expected %d, got %d\n", target, n, len(args.Args)-x)
+			os.Exit(2)
+		}
+		x += n
 	}
 	if len(unknown) == 1 {
 		logger.Println("Unknown target specified:", unknown[0])
@@ -240,6 +496,16 @@ Options:
 				fmt.Println({{printf "%q" .Comment}})
 				fmt.Println()
 				{{end}}
+				{{- if or .Args .Options}}
+				fmt.Print("Usage:\n\n\t{{$.BinaryName}} {{lower .TargetName}}{{if .Options}} [options]{{end}}{{range .Args}} <{{.Name}}>{{end}}\n\n")
+				{{end}}
+				{{- if .Options}}
+				fmt.Println("Options:")
+				fs, _ := targetFlags["{{lower .TargetName}}"]()
+				fs.SetOutput(os.Stdout)
+				fs.PrintDefaults()
+				fmt.Println()
+				{{end}}
 				var aliases []string
 				{{- $name := .Name -}}
 				{{- $recv := .Receiver -}}
@@ -266,8 +532,12 @@ Options:
 			}
 			return
 		}
+		if args.DryRun {
+			fmt.Println("target:", "{{.DefaultFunc.TargetName}}")
+		}
 		{{.DefaultFunc.ExecCode}}
 		handleError(logger, err)
+		writeTrace()
 		return
 	{{- else}}
 		if err := list(); err != nil {
@@ -277,7 +547,9 @@ Options:
 		return
 	{{- end}}
 	}
-	for _, target := range args.Args {
+	for x := 0; x < len(args.Args); {
+		target := args.Args[x]
+		x++
 		switch strings.ToLower(target) {
 		{{range $alias, $func := .Aliases}}
 			case "{{lower $alias}}":
@@ -290,6 +562,9 @@ Options:
 				if args.Verbose {
 					logger.Println("Running target:", "{{.TargetName}}")
 				}
+				if args.DryRun {
+					fmt.Println("target:", "{{.TargetName}}")
+				}
 				{{.ExecCode}}
 				handleError(logger, err)
 		{{- end}}
@@ -300,16 +575,20 @@ Options:
 					if args.Verbose {
 						logger.Println("Running target:", "{{.TargetName}}")
 					}
+					if args.DryRun {
+						fmt.Println("target:", "{{.TargetName}}")
+					}
 					{{.ExecCode}}
 					handleError(logger, err)
 			{{- end}}
 		{{- end}}
 		default:
 			// should be impossible since we check this above.
-			logger.Printf("Unknown target: %q\n", args.Args[0])
+			logger.Printf("Unknown target: %q\n", target)
 			os.Exit(1)
 		}
 	}
+	writeTrace()
 }
 
 
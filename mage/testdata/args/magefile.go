@@ -0,0 +1,45 @@
+//+build mage
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Deploys the given environment.
+func Deploy(ctx context.Context, env string, replicas int, dryRun bool) error {
+	fmt.Printf("deploy %s %d %t\n", env, replicas, dryRun)
+	return nil
+}
+
+func Wait(d time.Duration, ratio float64) {
+	fmt.Printf("wait %v %v\n", d, ratio)
+}
+
+func Status() {
+	fmt.Println("status")
+}
+
+type TestOpts struct {
+	Race    bool          `help:"run tests with the race detector"`
+	Count   int           `default:"1" help:"number of times to run each test"`
+	Pkg     string        `flag:"pkg" default:"./..." help:"packages to test"`
+	Timeout time.Duration `default:"10m"`
+	Ignored string        `flag:"-"`
+}
+
+// Runs the tests.
+func Test(opts TestOpts) {
+	fmt.Printf("test %t %d %s %v\n", opts.Race, opts.Count, opts.Pkg, opts.Timeout)
+}
+
+type ReleaseOpts struct {
+	Sign bool
+}
+
+func Release(ctx context.Context, version string, opts ReleaseOpts) error {
+	fmt.Printf("release %s %t\n", version, opts.Sign)
+	return nil
+}
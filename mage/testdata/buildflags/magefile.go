@@ -0,0 +1,13 @@
+//+build mage
+
+package main
+
+import "fmt"
+
+// version is set with -ldflags.
+var version = "dev"
+
+// Prints the version.
+func Version() {
+	fmt.Println(version)
+}
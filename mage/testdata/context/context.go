@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/magefile/mage/mg"
+	"github.com/magefile/mage/sh"
 )
 
 // Returns a non-nil error.
@@ -28,3 +29,8 @@ func TakesContextWithError(ctx context.Context) error {
 func CtxDeps(ctx context.Context) {
 	mg.CtxDeps(ctx, TakesContextNoError)
 }
+
+// Runs a command that touches $STOPPED_FILE if it isn't stopped.
+func Command(ctx context.Context) error {
+	return sh.RunCtx(ctx, "sh", "-c", "sleep 2 && touch $STOPPED_FILE")
+}
@@ -0,0 +1,24 @@
+//+build mage
+
+package main
+
+import (
+	"github.com/magefile/mage/mg"
+	"github.com/magefile/mage/sh"
+)
+
+// Builds the binary.
+func Build() error {
+	mg.Deps(Generate, Clean)
+	return sh.RunWith(map[string]string{"GOOS": "linux"}, "thiswontwork", "build", "-o", "bin/my app")
+}
+
+// Generates code.
+func Generate() error {
+	return sh.Run("thiswontwork", "generate", "./...")
+}
+
+// Removes build output.
+func Clean() error {
+	return sh.Rm("bin")
+}
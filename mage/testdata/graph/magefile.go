@@ -0,0 +1,46 @@
+//+build mage
+
+package main
+
+import (
+	"context"
+
+	"github.com/magefile/mage/mg"
+)
+
+var Aliases = map[string]interface{}{
+	"b": Build,
+}
+
+// Builds the binaries.
+func Build(ctx context.Context) {
+	mg.CtxDeps(ctx, Generate, NS.Lint)
+	mg.Deps(mg.F(buildFor, "linux"))
+	mg.WeightedCtxDeps(ctx, 2, download)
+}
+
+// Generates code.
+func Generate() {
+	mg.SerialDeps(tools, download)
+}
+
+// Releases everything.
+func Release() {
+	deps := []interface{}{Build}
+	mg.Deps(deps...)
+	mg.Deps(func() {})
+	build := Build
+	mg.Deps(build)
+}
+
+func tools()    {}
+func download() {}
+
+func buildFor(goos string) {
+	mg.WeightedDeps(2, tools)
+}
+
+type NS mg.Namespace
+
+// Lints the code.
+func (NS) Lint() {}
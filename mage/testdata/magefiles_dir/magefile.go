@@ -0,0 +1,6 @@
+//+build mage
+
+package main
+
+// Is ignored, since there's a magefiles directory.
+func Ignored() {}
@@ -0,0 +1,5 @@
+package main
+
+func helper() string {
+	return "from helper.go"
+}
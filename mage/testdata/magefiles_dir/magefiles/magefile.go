@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Prints the directory the target runs in.
+func Where() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Base(wd), helper())
+	return nil
+}
@@ -0,0 +1,4 @@
+package sub
+
+// Sub is here so that this directory has go files, but no magefiles.
+const Sub = "sub"
@@ -0,0 +1,24 @@
+//+build mage
+
+package main
+
+import (
+	"github.com/magefile/mage/mg"
+	"github.com/magefile/mage/sh"
+)
+
+// Builds the binary.
+func Build() error {
+	mg.Deps(Generate, Lint)
+	return sh.RunV("echo", "building")
+}
+
+// Generates code.
+func Generate() error {
+	return sh.RunV("echo", "generating\nmore generating")
+}
+
+// Lints code.
+func Lint() error {
+	return sh.RunV("echo", "linting")
+}
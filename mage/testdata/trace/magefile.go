@@ -0,0 +1,31 @@
+//+build mage
+
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/magefile/mage/mg"
+)
+
+// Builds the binary.
+func Build() {
+	mg.Deps(Generate, Lint)
+}
+
+// Generates code.
+func Generate() {
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Lints code.
+func Lint() {
+	time.Sleep(10 * time.Millisecond)
+}
+
+// Fails.
+func Fail() error {
+	mg.Deps(Generate)
+	return errors.New("oops")
+}
@@ -0,0 +1,21 @@
+//+build mage
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/magefile/mage/mg"
+)
+
+// Prints the directory the target runs in, and the magefile directory.
+func Where() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(filepath.Base(wd), filepath.Base(mg.MagefileDir()))
+	return nil
+}
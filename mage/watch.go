@@ -0,0 +1,186 @@
+package mage
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/magefile/mage/internal"
+	"github.com/magefile/mage/parse"
+)
+
+// defaultWatch are the file patterns watched for targets that don't declare
+// any in the Watch variable of the magefiles.
+var defaultWatch = []string{"**/*.go"}
+
+var (
+	// watchInterval is how often mage -watch checks files for changes.
+	watchInterval = 500 * time.Millisecond
+	// watchDebounce is how long files must stop changing before mage -watch
+	// reruns the target, so that a burst of changes only reruns it once.
+	watchDebounce = 200 * time.Millisecond
+	// killGrace is how long a magefile has to exit after being interrupted
+	// before it is killed.
+	killGrace = 5 * time.Second
+)
+
+// runWatch runs the target in inv.Args, and reruns it whenever the magefiles or
+// the files matching the target's watch patterns change, until interrupted.
+func runWatch(inv Invocation) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return watch(ctx, inv)
+}
+
+// watch runs the target in inv.Args until ctx is cancelled, restarting it when
+// files change.  Changes to the magefiles cause them to be recompiled, since
+// that happens whenever they differ from the cached binary.
+func watch(ctx context.Context, inv Invocation) int {
+	errlog := log.New(inv.Stderr, "", 0)
+	if inv.GoCmd == "" {
+		inv.GoCmd = "go"
+	}
+	if inv.Dir == "" {
+		root, _, _, err := searchMagefiles(inv)
+		if err != nil {
+			errlog.Println("Error determining list of magefiles:", err)
+			return 1
+		}
+		inv.Dir = root
+	}
+	for {
+		sets := watchSets(inv)
+		prev := watchState(sets)
+		runCtx, stop := context.WithCancel(ctx)
+		done := make(chan int, 1)
+		go func() { done <- invoke(runCtx, inv) }()
+		running := true
+
+		changed := false
+		for !changed {
+			select {
+			case <-ctx.Done():
+				stop()
+				if running {
+					<-done
+				}
+				return 0
+			case code := <-done:
+				running = false
+				errlog.Printf("mage: exited with code %d, waiting for changes", code)
+			case <-time.After(watchInterval):
+				cur := watchState(sets)
+				changed = !sameState(prev, cur)
+				prev = cur
+			}
+		}
+		// wait for the files to stop changing.
+		for {
+			select {
+			case <-ctx.Done():
+				stop()
+				if running {
+					<-done
+				}
+				return 0
+			case <-time.After(watchDebounce):
+			}
+			cur := watchState(sets)
+			if sameState(prev, cur) {
+				break
+			}
+			prev = cur
+		}
+		stop()
+		if running {
+			<-done
+		}
+		errlog.Println("mage: files changed, rerunning", strings.Join(inv.Args, " "))
+	}
+}
+
+// watchSet is a directory and the patterns of the files in it to watch.
+type watchSet struct {
+	dir      string
+	patterns []string
+}
+
+// watchSets returns the files to watch for inv.  The go files in the directory
+// holding the magefiles are always watched.  So are the files matching the
+// patterns declared for the targets in inv.Args, or the default patterns if
+// there are none, in the directory the targets run in.
+func watchSets(inv Invocation) []watchSet {
+	dir, files, err := findMagefiles(inv)
+	// the mainfile is created while compiling, which isn't a change.
+	mage := watchSet{dir: dir, patterns: []string{"*.go", "!" + mainfile}}
+	var declared []string
+	if err == nil && len(files) > 0 {
+		fnames := make([]string, 0, len(files))
+		for i := range files {
+			fnames = append(fnames, filepath.Base(files[i]))
+		}
+		if info, err := parse.PrimaryPackage(inv.GoCmd, dir, fnames); err == nil {
+			for _, arg := range inv.Args {
+				declared = append(declared, info.Watch[strings.ToLower(arg)]...)
+			}
+		}
+	}
+	if len(declared) == 0 {
+		declared = defaultWatch
+	}
+	return []watchSet{mage, {dir: workDir(inv), patterns: declared}}
+}
+
+// fileStamp is what mage -watch compares to tell if a file has changed.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watchState returns the stamps of the files in sets.  Files that can't be
+// read are left out, so they count as changed once they can be.
+func watchState(sets []watchSet) map[string]fileStamp {
+	state := map[string]fileStamp{}
+	for _, set := range sets {
+		files, err := internal.Glob(set.dir, set.patterns)
+		if err != nil {
+			debug.Println("error finding files to watch:", err)
+			continue
+		}
+		for _, f := range files {
+			path := filepath.Join(set.dir, filepath.FromSlash(f))
+			fi, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			state[path] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return state
+}
+
+func sameState(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f, stamp := range a {
+		if other, ok := b[f]; !ok || !other.modTime.Equal(stamp.modTime) || other.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
@@ -75,10 +75,14 @@ func TestMakeDependency(t *testing.T) {
 	})
 }
 
+type testCtxKey struct{}
+
 // TestRunTargetDependency must pass for targets to reliably be run as
 // dependencies.
 func TestRunTargetDependency(t *testing.T) {
-	todo := context.TODO()
+	// dependencies are given a context derived from the one passed to
+	// RunDependency, which also records the dependency that's running.
+	todo := context.WithValue(context.TODO(), testCtxKey{}, "todo")
 	errTest := errors.New(`test`)
 	t.Run(`NoContextNoErr`, func(t *testing.T) {
 		d, _ := makeDependency(t1)
@@ -108,7 +112,7 @@ func TestRunTargetDependency(t *testing.T) {
 			t.Error(`expected function to be run`)
 			return
 		}
-		if t2ctx != todo {
+		if t2ctx == nil || t2ctx.Value(testCtxKey{}) != "todo" {
 			t.Error(`expected function to be given context`)
 		}
 		if err != nil {
@@ -155,7 +159,7 @@ func TestRunTargetDependency(t *testing.T) {
 			t.Error(`expected function to be run`)
 			return
 		}
-		if t4ctx != todo {
+		if t4ctx == nil || t4ctx.Value(testCtxKey{}) != "todo" {
 			t.Error(`expected function to be given context`)
 		}
 		switch err {
@@ -1,18 +1,25 @@
 package mg
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var logger = log.New(os.Stderr, "", 0)
 
+// planOut is where the names of dependencies are printed in a dry run.
+var planOut io.Writer = os.Stdout
+
 // SerialDeps is like Deps except it runs each dependency serially, instead of
 // in parallel. This can be useful for resource intensive dependencies that
 // shouldn't be run at the same time.
@@ -22,11 +29,20 @@ func SerialDeps(fns ...interface{}) { SerialCtxDeps(context.Background(), fns...
 // instead of in parallel. This can be useful for resource intensive
 // dependencies that shouldn't be run at the same time.
 func SerialCtxDeps(ctx context.Context, fns ...interface{}) {
+	serialDeps(ctx, 1, fns)
+}
+
+func serialDeps(ctx context.Context, weight int, fns []interface{}) {
 	deps, err := makeDependencies(fns...)
 	if err != nil {
 		panic(Fatal(1, err.Error()))
 	}
 
+	// the dependencies need job slots of their own, so give up the caller's
+	// while they run.
+	st := stateOf(ctx)
+	defer yieldJobs(st)()
+	ctx = withState(ctx, depState{dep: st.dep, weight: weight, out: st.out})
 	for _, dep := range deps {
 		err := dep.RunDependency(ctx)
 		if err == nil {
@@ -37,7 +53,7 @@ func SerialCtxDeps(ctx context.Context, fns ...interface{}) {
 		if nd, ok := dep.(NamedDependency); ok {
 			msg = fmt.Sprintf(`%v: %v`, nd.DependencyName(), msg)
 		}
-		panic(Fatal(exit, err.Error()))
+		panic(Fatal(exit, msg))
 	}
 }
 
@@ -47,19 +63,59 @@ func SerialCtxDeps(ctx context.Context, fns ...interface{}) {
 //     func() error
 //     func(context.Context)
 //     func(context.Context) error
-// Or a similar method on a mg.Namespace type.
+// Or a similar method on a mg.Namespace type.  Functions that take other
+// arguments may be wrapped with F.
 //
 // The function calling Deps is guaranteed that all dependent functions will be
 // run exactly once when Deps returns.  Dependent functions may in turn declare
 // their own dependencies using Deps. Each dependency is run in their own
 // goroutines. Each function is given the context provided if the function
-// prototype allows for it.
+// prototype allows for it.  In a dry run, the dependencies are run serially so
+// that the plan is printed in a predictable order.
+//
+// If a limit has been set on the number of jobs (see Jobs), each dependency
+// waits for a free job slot before running.  A dependency gives up its slot
+// while waiting on its own dependencies.
+//
+// The context given to a dependency records which dependency is running, so a
+// dependency that passes its context on to CtxDeps has the dependencies it
+// starts counted as its own.  If one of them would end up waiting on the
+// dependency that started it, however indirectly, that causes an error rather
+// than a deadlock.  Dependencies started with Deps, which has no context, are
+// not known to have been started by any dependency.
 func CtxDeps(ctx context.Context, fns ...interface{}) {
+	ctxDeps(ctx, 1, fns)
+}
+
+// WeightedCtxDeps is like CtxDeps, except each dependency that it runs takes
+// the given number of job slots instead of one, up to the limit set by Jobs.
+// This can be useful for dependencies that use enough resources that fewer of
+// them should run at the same time.
+func WeightedCtxDeps(ctx context.Context, weight int, fns ...interface{}) {
+	ctxDeps(ctx, weight, fns)
+}
+
+// WeightedDeps is like Deps, except each dependency that it runs takes the
+// given number of job slots instead of one.  See WeightedCtxDeps.
+func WeightedDeps(weight int, fns ...interface{}) {
+	ctxDeps(context.Background(), weight, fns)
+}
+
+func ctxDeps(ctx context.Context, weight int, fns []interface{}) {
+	if DryRun() {
+		serialDeps(ctx, weight, fns)
+		return
+	}
 	deps, err := makeDependencies(fns...)
 	if err != nil {
 		panic(Fatal(1, err.Error()))
 	}
 
+	// the dependencies need job slots of their own, so give up the caller's
+	// while they run.
+	st := stateOf(ctx)
+	reclaim := yieldJobs(st)
+	ctx = withState(ctx, depState{dep: st.dep, weight: weight, out: st.out})
 	errs := make([]error, len(deps))
 	var group sync.WaitGroup
 	for i, dep := range deps {
@@ -75,6 +131,7 @@ func CtxDeps(ctx context.Context, fns ...interface{}) {
 		}(&errs[i], dep)
 	}
 	group.Wait()
+	reclaim()
 
 	exit := 0
 	msgs := make([]string, 0, len(errs))
@@ -111,7 +168,8 @@ func recoverPanic(perr *error) {
 //     func() error
 //     func(context.Context)
 //     func(context.Context) error
-// Or a similar method on a mg.Namespace type.
+// Or a similar method on a mg.Namespace type.  Functions that take other
+// arguments may be wrapped with F.
 //
 // This is a way to build up a tree of dependencies with each dependency
 // defining its own dependencies.  Functions must have the same signature as a
@@ -173,7 +231,7 @@ func makeDependency(dep interface{}) (Dependency, error) {
 	case Dependency:
 		return dep, nil
 	case func(context.Context) error:
-		return needTargetDep(name(dep), dep), nil
+		return needTargetDep(name(dep), displayName(name(dep)), dep), nil
 	}
 
 	// time to get reflective..
@@ -207,7 +265,7 @@ func makeDependency(dep interface{}) (Dependency, error) {
 		return nil, fmt.Errorf(msgInvalidType, dep)
 	}
 
-	return needTargetDep(name(dep), func(ctx context.Context) error {
+	return needTargetDep(name(dep), displayName(name(dep)), func(ctx context.Context) error {
 		in := make([]reflect.Value, 0, 2)
 		if hasNamespace {
 			in = append(in, reflect.Zero(dt.In(0)))
@@ -226,6 +284,168 @@ func makeDependency(dep interface{}) (Dependency, error) {
 	}), nil
 }
 
+// F returns a Dependency that calls the target function with the given
+// arguments, so that functions which take arguments may be passed to Deps:
+//
+//     mg.Deps(mg.F(BuildFor, "linux", "amd64"), mg.F(BuildFor, "darwin", "arm64"))
+//
+// The target may take an optional context.Context (or be a method on a
+// mg.Namespace) followed by parameters matching the given args, and may
+// optionally return an error.  Each distinct combination of target and
+// arguments is run exactly once.  Numbers are converted to the type of the
+// parameter they're passed for if it can hold them exactly, so that mg.F(fn, 64)
+// works for a parameter of type int64.  F panics if the arguments do not match
+// the target's parameters.
+func F(target interface{}, args ...interface{}) Dependency {
+	dep, err := makeFnDependency(target, args)
+	if err != nil {
+		panic(Fatal(1, err.Error()))
+	}
+	return dep
+}
+
+// argValue returns arg as a value of type t, to pass to a target given to F.
+// Nil is only allowed for types that can be nil.  Other values must be
+// assignable to t, or be of the same kind of value, such as a string for a
+// named string type, or a number that t can hold exactly, so that untyped
+// constants like 64 can be passed for an int64 or float64.
+func argValue(arg interface{}, t reflect.Type) (reflect.Value, bool) {
+	if arg == nil {
+		switch t.Kind() {
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice, reflect.UnsafePointer:
+			return reflect.Zero(t), true
+		}
+		return reflect.Value{}, false
+	}
+	v := reflect.ValueOf(arg)
+	switch {
+	case v.Type().AssignableTo(t):
+		return v, true
+	case !v.Type().ConvertibleTo(t):
+		return reflect.Value{}, false
+	case v.Kind() == t.Kind():
+		return v.Convert(t), true
+	case isNumber(v.Kind()) && isNumber(t.Kind()):
+		// only convert to integers that hold the same value, so that values
+		// aren't truncated or overflow.  Floats may lose precision, as
+		// constants do.
+		c := v.Convert(t)
+		if !isFloat(t.Kind()) && c.Convert(v.Type()).Interface() != v.Interface() {
+			return reflect.Value{}, false
+		}
+		if isUnsigned(t.Kind()) && isNegative(v) {
+			return reflect.Value{}, false
+		}
+		return c, true
+	}
+	return reflect.Value{}, false
+}
+
+func isUnsigned(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	}
+	return false
+}
+
+func isNegative(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() < 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() < 0
+	}
+	return false
+}
+
+func isFloat(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// fnDep is a targetDep for a target called with arguments given to F.
+type fnDep struct {
+	targetDep
+}
+
+// DependencyName implements NamedDependency, reporting the target along with
+// its arguments.
+func (dep fnDep) DependencyName() string {
+	return dep.getRun().name
+}
+
+func makeFnDependency(target interface{}, args []interface{}) (Dependency, error) {
+	tv := reflect.ValueOf(target)
+	if tv.Kind() != reflect.Func {
+		return nil, fmt.Errorf(msgInvalidType, target)
+	}
+	tt := tv.Type()
+
+	hasNamespace, hasContext, hasError := false, false, false
+	x, i := 0, tt.NumIn()
+	if x < i && isNamespace(tt.In(x)) {
+		hasNamespace = true
+		x++
+	}
+	if x < i && isContext(tt.In(x)) {
+		hasContext = true
+		x++
+	}
+	if tt.IsVariadic() || i-x != len(args) {
+		return nil, fmt.Errorf("%s takes %d arguments, but was given %d", displayName(name(target)), i-x, len(args))
+	}
+	vals := make([]reflect.Value, len(args))
+	strs := make([]string, len(args))
+	for n, arg := range args {
+		pt := tt.In(x + n)
+		v, ok := argValue(arg, pt)
+		if !ok {
+			return nil, fmt.Errorf("argument %d to %s must be %v, but was %T", n+1, displayName(name(target)), pt, arg)
+		}
+		vals[n] = v
+		if arg == nil {
+			strs[n] = fmt.Sprintf("%#v", arg)
+		} else {
+			strs[n] = fmt.Sprintf("%#v", v.Interface())
+		}
+	}
+
+	o := tt.NumOut()
+	if o > 0 && isError(tt.Out(0)) {
+		hasError = true
+	}
+	if o > 1 || (o == 1 && !hasError) {
+		return nil, fmt.Errorf(msgInvalidType, target)
+	}
+
+	id := name(target) + "(" + strings.Join(strs, ", ") + ")"
+	display := displayName(name(target)) + "(" + strings.Join(strs, ", ") + ")"
+	return fnDep{needTargetDep(id, display, func(ctx context.Context) error {
+		in := make([]reflect.Value, 0, 2+len(vals))
+		if hasNamespace {
+			in = append(in, reflect.Zero(tt.In(0)))
+		}
+		if hasContext {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		out := tv.Call(append(in, vals...))
+		if !hasError || out[0].IsNil() {
+			return nil
+		}
+		return out[0].Interface().(error)
+	})}, nil
+}
+
 func isNamespace(t reflect.Type) bool {
 	if t.Kind() != reflect.Struct {
 		return false
@@ -257,11 +477,48 @@ type targetDep string
 
 // RunDependency implements Dependency using a global map of function addresses
 // to sync.Once.  This ensures a target is only run once.
+//
+// If the target is waiting, however indirectly, on the dependency that made
+// this call, waiting for it would deadlock, so RunDependency instead returns
+// an error describing the cycle.
 func (dep targetDep) RunDependency(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	run := dep.getRun()
+	st := stateOf(ctx)
+	if err := startWaiting(st.dep, dep); err != nil {
+		return err
+	}
+	defer stopWaiting(st.dep, dep)
 	run.once.Do(func() {
+		weight := st.weight
+		if weight < 1 {
+			weight = 1
+		}
+		slots := &jobSlots{n: acquireJobs(weight)}
+		defer releaseJobs(slots.n)
+		var out *outputBuffer
+		if Buffer() {
+			out = &outputBuffer{}
+			defer out.flush()
+		}
+		running := depState{dep: dep, slots: slots, out: out}
+		defer setRunning(running)()
+		ctx := withState(ctx, running)
+		start := time.Now()
+		defer func() {
+			if r := recover(); r != nil {
+				recordTrace(run.name, start, fmt.Errorf("%v", r))
+				panic(r)
+			}
+			recordTrace(run.name, start, run.err)
+		}()
 		if Verbose() {
-			logger.Println("Running dependency:", displayName(string(dep)))
+			logger.Println("Running dependency:", run.name)
+		}
+		if DryRun() {
+			fmt.Fprintln(planOut, "dep:", run.name)
 		}
 		run.err = run.fn(ctx)
 	})
@@ -269,13 +526,14 @@ func (dep targetDep) RunDependency(ctx context.Context) error {
 }
 
 // needTargetDep ensures we have a targetRun record and returns a targetDep.
-func needTargetDep(id string, fn targetFunc) targetDep {
+// The display name is used to identify the target in log output.
+func needTargetDep(id, display string, fn targetFunc) targetDep {
 	targetRunCtl.Lock()
 	defer targetRunCtl.Unlock()
 	dep := targetDep(id)
 	_, dup := targetRunMap[dep]
 	if !dup {
-		targetRunMap[dep] = &targetRun{fn: fn}
+		targetRunMap[dep] = &targetRun{fn: fn, name: display}
 	}
 	return dep
 }
@@ -295,10 +553,149 @@ type targetRun struct {
 	once sync.Once
 	err  error
 	fn   targetFunc
+	name string
 }
 
 type targetFunc func(ctx context.Context) error
 
+// depState is what the dependency running with a context is doing with
+// respect to running dependencies.  It is carried by the contexts given to
+// dependencies, so that a call to CtxDeps can tell which dependency made it.
+// It is also recorded for the goroutine running the dependency, so that a call
+// to Deps, which has no context to carry it, can tell as well.
+type depState struct {
+	dep    targetDep     // the dependency running, or "" outside of one
+	weight int           // the job slots the dependencies started from here take
+	slots  *jobSlots     // the job slots held by the dependency running
+	out    *outputBuffer // where command output is held, if it's being buffered
+}
+
+type depStateKey struct{}
+
+// stateOf returns the state carried by ctx, which may be nil.  If ctx carries
+// none, it returns the state of the dependency running on this goroutine.
+func stateOf(ctx context.Context) depState {
+	if ctx != nil {
+		if st, ok := ctx.Value(depStateKey{}).(depState); ok {
+			return st
+		}
+	}
+	runningCtl.Lock()
+	defer runningCtl.Unlock()
+	return running[goroutineID()]
+}
+
+// withState returns a copy of ctx that carries st.
+func withState(ctx context.Context, st depState) context.Context {
+	return context.WithValue(ctx, depStateKey{}, st)
+}
+
+// running is the state of the dependency each goroutine is running, by
+// goroutine ID.
+var (
+	runningCtl sync.Mutex
+	running    = make(map[uint64]depState)
+)
+
+// setRunning records st as the state of the dependency running on this
+// goroutine until the returned function is called, which restores whatever
+// was running before it; serial dependencies run on their caller's goroutine.
+func setRunning(st depState) (restore func()) {
+	id := goroutineID()
+	runningCtl.Lock()
+	old, ok := running[id]
+	running[id] = st
+	runningCtl.Unlock()
+	return func() {
+		runningCtl.Lock()
+		defer runningCtl.Unlock()
+		if ok {
+			running[id] = old
+		} else {
+			delete(running, id)
+		}
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine, which Go only reveals
+// in the "goroutine N [status]:" header of its stack trace.
+func goroutineID() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// waits is the graph of which running dependencies are waiting on which: each
+// call one dependency makes to run another is counted in waits[from][to] until
+// it returns.
+var (
+	waitsCtl sync.Mutex
+	waits    = make(map[targetDep]map[targetDep]int)
+)
+
+// startWaiting records that from is waiting on to, or returns an error
+// describing the cycle if to is already waiting on from, however indirectly,
+// since neither could ever finish.  From is "" if the caller isn't a known
+// dependency, in which case there is nothing to record.
+func startWaiting(from, to targetDep) error {
+	if from == "" {
+		return nil
+	}
+	waitsCtl.Lock()
+	defer waitsCtl.Unlock()
+	if path := waitPath(to, from, map[targetDep]bool{}); path != nil {
+		names := make([]string, 0, len(path)+1)
+		for _, d := range append(path, to) {
+			names = append(names, d.getRun().name)
+		}
+		return Fatalf(1, "dependency cycle detected: %s", strings.Join(names, " -> "))
+	}
+	if waits[from] == nil {
+		waits[from] = make(map[targetDep]int)
+	}
+	waits[from][to]++
+	return nil
+}
+
+// stopWaiting removes what startWaiting recorded.
+func stopWaiting(from, to targetDep) {
+	if from == "" {
+		return
+	}
+	waitsCtl.Lock()
+	defer waitsCtl.Unlock()
+	if waits[from][to]--; waits[from][to] == 0 {
+		delete(waits[from], to)
+	}
+	if len(waits[from]) == 0 {
+		delete(waits, from)
+	}
+}
+
+// waitPath returns the dependencies from from to to, following what each is
+// waiting on, or nil if from isn't waiting on to.  It must be called with
+// waitsCtl held.
+func waitPath(from, to targetDep, seen map[targetDep]bool) []targetDep {
+	if from == to {
+		return []targetDep{from}
+	}
+	if seen[from] {
+		return nil
+	}
+	seen[from] = true
+	for next := range waits[from] {
+		if path := waitPath(next, to, seen); path != nil {
+			return append([]targetDep{from}, path...)
+		}
+	}
+	return nil
+}
+
 func name(i interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 }
@@ -2,6 +2,7 @@ package mg
 
 import (
 	"bytes"
+	"context"
 	"log"
 	"os"
 	"strings"
@@ -33,3 +34,77 @@ func bar() {
 }
 
 func baz() {}
+
+func TestFLogging(t *testing.T) {
+	os.Setenv("MAGEFILE_VERBOSE", "1")
+	defer os.Unsetenv("MAGEFILE_VERBOSE")
+	buf := &bytes.Buffer{}
+
+	defaultLogger := logger
+	logger = log.New(buf, "", 0)
+	defer func() { logger = defaultLogger }()
+
+	Deps(F(buildFor, "linux", 64))
+
+	expected := "Running dependency: github.com/magefile/mage/mg.buildFor(\"linux\", 64)\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, buf)
+	}
+}
+
+func buildFor(goos string, bits int) {}
+
+func TestDepsDryRun(t *testing.T) {
+	os.Setenv(DryRunEnv, "1")
+	defer os.Unsetenv(DryRunEnv)
+	buf := &bytes.Buffer{}
+
+	defaultOut := planOut
+	planOut = buf
+	defer func() { planOut = defaultOut }()
+
+	Deps(dryA, dryB)
+
+	expected := "dep: github.com/magefile/mage/mg.dryA\ndep: github.com/magefile/mage/mg.dryC\ndep: github.com/magefile/mage/mg.dryB\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, buf)
+	}
+}
+
+func dryA() { Deps(dryC) }
+
+func dryB() { Deps(dryC) }
+
+func dryC() {}
+
+func TestDepsBuffer(t *testing.T) {
+	os.Setenv(BufferEnv, "1")
+	defer os.Unsetenv(BufferEnv)
+	buf := &bytes.Buffer{}
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	var names []string
+	slow := func(ctx context.Context) {
+		w := OutputTo(ctx, buf)
+		names = append(names, CurrentTarget(ctx))
+		w.Write([]byte("slow 1\n"))
+		close(started)
+		<-finished
+		w.Write([]byte("slow 2\n"))
+	}
+	fast := func(ctx context.Context) {
+		defer close(finished)
+		<-started
+		w := OutputTo(ctx, buf)
+		w.Write([]byte("fast 1\n"))
+		w.Write([]byte("fast 2\n"))
+	}
+	Deps(slow, fast)
+	// without buffering, slow's lines would be on either side of fast's.
+	if out := buf.String(); out != "fast 1\nfast 2\nslow 1\nslow 2\n" && out != "slow 1\nslow 2\nfast 1\nfast 2\n" {
+		t.Fatalf("expected each dependency's output together, got %q", buf)
+	}
+	if len(names) != 1 || !strings.HasSuffix(names[0], "TestDepsBuffer.func1") {
+		t.Fatalf("expected the name of the running dependency, got %q", names)
+	}
+}
@@ -2,9 +2,13 @@ package mg
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -192,3 +196,168 @@ func TestDepsErrors(t *testing.T) {
 	}()
 	f()
 }
+
+func TestF(t *testing.T) {
+	ch := make(chan string, 4)
+	f := func(ctx context.Context, goos, goarch string) {
+		ch <- goos + "/" + goarch
+	}
+	Deps(F(f, "linux", "amd64"), F(f, "darwin", "arm64"), F(f, "linux", "amd64"))
+	SerialDeps(F(f, "darwin", "arm64"))
+	close(ch)
+
+	var got []string
+	for s := range ch {
+		got = append(got, s)
+	}
+	sort.Strings(got)
+	expected := []string{"darwin/arm64", "linux/amd64"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected each set of args to run once, %q, but got %q", expected, got)
+	}
+}
+
+func TestFError(t *testing.T) {
+	f := func(n int) error {
+		return fmt.Errorf("bad %d", n)
+	}
+	defer func() {
+		v := recover()
+		if v == nil {
+			t.Fatal("expected panic, but didn't get one")
+		}
+		actual := fmt.Sprint(v)
+		expected := "github.com/magefile/mage/mg.TestFError.func1(3): bad 3"
+		if actual != expected {
+			t.Fatalf(`expected to get %q but got %q`, expected, actual)
+		}
+	}()
+	Deps(F(f, 3))
+}
+
+func TestFBadArgs(t *testing.T) {
+	f := func(s string) {}
+	for _, args := range [][]interface{}{{}, {1}, {"a", "b"}, {nil}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected F to panic for args %v", args)
+				}
+			}()
+			F(f, args...)
+		}()
+	}
+}
+
+type testGOOS string
+
+func TestFConvert(t *testing.T) {
+	var got string
+	f := func(n int64, x float32, goos testGOOS, tags []string) {
+		got = fmt.Sprintln(n, x, goos, tags == nil)
+	}
+	SerialDeps(F(f, 64, 0.5, "linux", nil))
+	if expected := "64 0.5 linux true\n"; got != expected {
+		t.Fatalf("expected converted args %q, but got %q", expected, got)
+	}
+
+	small := func(n int8, m uint) {}
+	for _, args := range [][]interface{}{{300, 1}, {1.5, 1}, {1, -1}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected F to panic for args %v that don't fit", args)
+				}
+			}()
+			F(small, args...)
+		}()
+	}
+}
+
+func TestDepsCycle(t *testing.T) {
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		Deps(cycleBuild)
+	}()
+	select {
+	case v := <-done:
+		if v == nil {
+			t.Fatal("expected panic, but didn't get one")
+		}
+		err, ok := v.(error)
+		if !ok {
+			t.Fatalf("expected recovered val to be error but was %T", v)
+		}
+		expected := "dependency cycle detected: github.com/magefile/mage/mg.cycleBuild -> github.com/magefile/mage/mg.cycleGenerate -> github.com/magefile/mage/mg.cycleBuild"
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error to contain %q, but got %q", expected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dependency cycle deadlocked")
+	}
+}
+
+func cycleBuild(ctx context.Context) { SerialCtxDeps(ctx, cycleGenerate) }
+
+func cycleGenerate(ctx context.Context) { CtxDeps(ctx, cycleBuild) }
+
+// a cycle between dependencies started in parallel, rather than one inside
+// the other.
+func TestDepsCycleAcrossBranches(t *testing.T) {
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		Deps(branchA)
+	}()
+	select {
+	case v := <-done:
+		if v == nil {
+			t.Fatal("expected panic, but didn't get one")
+		}
+		err, ok := v.(error)
+		if !ok {
+			t.Fatalf("expected recovered val to be error but was %T", v)
+		}
+		if !strings.Contains(err.Error(), "dependency cycle detected: ") {
+			t.Fatalf("expected a dependency cycle error, but got %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dependency cycle deadlocked")
+	}
+}
+
+func branchA(ctx context.Context) { CtxDeps(ctx, branchB, branchC) }
+
+func branchB(ctx context.Context) { CtxDeps(ctx, branchC) }
+
+func branchC(ctx context.Context) { CtxDeps(ctx, branchB) }
+
+// a cycle between dependencies that call Deps without a context.
+func TestDepsCycleWithoutContext(t *testing.T) {
+	done := make(chan interface{})
+	go func() {
+		defer func() { done <- recover() }()
+		Deps(plainBuild)
+	}()
+	select {
+	case v := <-done:
+		if v == nil {
+			t.Fatal("expected panic, but didn't get one")
+		}
+		err, ok := v.(error)
+		if !ok {
+			t.Fatalf("expected recovered val to be error but was %T", v)
+		}
+		expected := "dependency cycle detected: github.com/magefile/mage/mg.plainBuild -> github.com/magefile/mage/mg.plainGenerate -> github.com/magefile/mage/mg.plainBuild"
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected error to contain %q, but got %q", expected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dependency cycle deadlocked")
+	}
+}
+
+func plainBuild() { Deps(plainGenerate) }
+
+func plainGenerate() { Deps(plainBuild) }
@@ -0,0 +1,81 @@
+package mg
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/magefile/mage/internal"
+)
+
+// File returns a Dependency that runs fn, a function as accepted by Deps or a
+// Dependency such as one returned by F, only if any of the outputs are missing
+// or older than the newest of the inputs.  This saves starting each target
+// that builds files with a check of whether it needs to:
+//
+//     mg.Deps(mg.File(Generate, []string{"api/api.pb.go"}, "api/*.proto"))
+//
+// When the outputs are up to date, "Dependency up to date:" is logged in
+// verbose mode instead of running fn.  After fn runs, it's an error if any of
+// the outputs don't exist.
+//
+// Outputs that are directories are compared by the modtimes of the files under
+// them.  Inputs may be files, directories or patterns, as with target.Glob.
+// File panics if fn is not a valid dependency.
+func File(fn interface{}, outputs []string, inputs ...string) Dependency {
+	dep, err := makeDependency(fn)
+	if err != nil {
+		panic(Fatal(1, err.Error()))
+	}
+	var depName string
+	if nd, ok := dep.(NamedDependency); ok {
+		depName = nd.DependencyName()
+	} else {
+		depName = displayName(name(fn))
+	}
+	return fileDep{dep: dep, name: depName, outputs: outputs, inputs: inputs}
+}
+
+// fileDep is a Dependency that only runs when its outputs are out of date.
+// The wrapped dependency ensures it is run only once.
+type fileDep struct {
+	dep     Dependency
+	name    string
+	outputs []string
+	inputs  []string
+}
+
+// DependencyName implements NamedDependency.
+func (dep fileDep) DependencyName() string {
+	return dep.name
+}
+
+// RunDependency implements Dependency.
+func (dep fileDep) RunDependency(ctx context.Context) error {
+	stale, err := internal.StaleOutputs(dep.outputs, dep.inputs)
+	if err != nil {
+		return err
+	}
+	if len(stale) == 0 {
+		if Verbose() {
+			logger.Println("Dependency up to date:", dep.name)
+		}
+		return nil
+	}
+	if err := dep.dep.RunDependency(ctx); err != nil {
+		return err
+	}
+	if DryRun() {
+		return nil
+	}
+	var missing []string
+	for _, out := range dep.outputs {
+		if _, err := os.Stat(out); err != nil {
+			missing = append(missing, out)
+		}
+	}
+	if len(missing) > 0 {
+		return Fatalf(1, "%s did not create %s", dep.name, strings.Join(missing, ", "))
+	}
+	return nil
+}
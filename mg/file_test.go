@@ -0,0 +1,116 @@
+package mg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTempDir changes to a new temporary directory until restore is called.
+func withTempDir(t *testing.T) (restore func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFile(t *testing.T) {
+	defer withTempDir(t)()
+	if err := ioutil.WriteFile("in.txt", []byte("in"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	build := func() error {
+		runs++
+		return ioutil.WriteFile("out.txt", []byte("out"), 0644)
+	}
+	if err := File(build, []string{"out.txt"}, "*.txt").RunDependency(nil); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("expected missing output to run the target once, but it ran %d times", runs)
+	}
+
+	// a new File wraps a new dependency, so only the outputs can stop it from
+	// running again.
+	buf := &bytes.Buffer{}
+	defaultLogger := logger
+	logger = log.New(buf, "", 0)
+	defer func() { logger = defaultLogger }()
+	os.Setenv(VerboseEnv, "1")
+	defer os.Unsetenv(VerboseEnv)
+	if err := File(F(build), []string{"out.txt"}, "in.txt").RunDependency(nil); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("expected up to date output to skip the target, but it ran %d times", runs)
+	}
+	if !strings.Contains(buf.String(), "Dependency up to date: ") {
+		t.Fatalf("expected up to date message, got %q", buf.String())
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes("in.txt", later, later); err != nil {
+		t.Fatal(err)
+	}
+	// build has already run once, so it needs a new dependency to run again.
+	rebuild := func() error { return build() }
+	if err := File(rebuild, []string{"out.txt"}, "in.txt").RunDependency(nil); err != nil {
+		t.Fatal(err)
+	}
+	if runs != 2 {
+		t.Fatalf("expected newer input to run the target again, but it ran %d times", runs)
+	}
+}
+
+func TestFileMissingOutput(t *testing.T) {
+	defer withTempDir(t)()
+	if err := os.Mkdir("src", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join("src", "in.txt"), []byte("in"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func() error {
+		return ioutil.WriteFile("a.txt", []byte("a"), 0644)
+	}
+	err := File(build, []string{"a.txt", "b.txt"}, "src").RunDependency(nil)
+	if err == nil {
+		t.Fatal("expected error for output the target didn't create")
+	}
+	expected := "mg.TestFileMissingOutput.func1 did not create b.txt"
+	if !strings.HasSuffix(err.Error(), expected) {
+		t.Fatalf("expected error %q, got %q", expected, err)
+	}
+	if code := ExitStatus(err); code != 1 {
+		t.Fatalf("expected exit status 1, got %d", code)
+	}
+}
+
+func TestFileMissingInput(t *testing.T) {
+	defer withTempDir(t)()
+	runs := 0
+	build := func() { runs++ }
+	if err := File(build, []string{"out.txt"}, "missing.txt").RunDependency(nil); err == nil {
+		t.Fatal("expected error for missing input")
+	}
+	if runs != 0 {
+		t.Fatal("expected target not to run with a missing input")
+	}
+}
@@ -0,0 +1,141 @@
+package mg
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// JobsEnv is the environment variable that sets the maximum number of
+// dependencies that may run at the same time.
+const JobsEnv = "MAGEFILE_JOBS"
+
+// Jobs returns the maximum number of dependencies that may run at the same
+// time, as set by the -j flag.  Zero means there is no limit.
+func Jobs() int {
+	n, _ := strconv.Atoi(os.Getenv(JobsEnv))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+var (
+	jobsOnce sync.Once
+	jobs     *semaphore // nil if there is no limit
+)
+
+// initJobs sets up the job slots the first time it's called, from the limit
+// set by the -j flag.
+func initJobs() {
+	jobsOnce.Do(func() {
+		if j := Jobs(); j > 0 {
+			jobs = newSemaphore(j)
+		}
+	})
+}
+
+// acquireJobs waits until n job slots are free and takes them, returning the
+// number taken, which is n limited to the total number of slots.
+func acquireJobs(n int) int {
+	initJobs()
+	if jobs == nil || n <= 0 {
+		return 0
+	}
+	if n > jobs.size {
+		n = jobs.size
+	}
+	jobs.acquire(n)
+	return n
+}
+
+// releaseJobs gives back n job slots taken with acquireJobs.
+func releaseJobs(n int) {
+	if jobs == nil || n <= 0 {
+		return
+	}
+	jobs.release(n)
+}
+
+// jobSlots are the job slots held by a running dependency, which it gives up
+// while it waits on dependencies of its own.
+type jobSlots struct {
+	mu      sync.Mutex
+	n       int
+	waiting int // the calls to Deps from the dependency that are waiting
+}
+
+// wait gives up the slots, unless another call to Deps from the same
+// dependency already has.
+func (s *jobSlots) wait() {
+	s.mu.Lock()
+	s.waiting++
+	first := s.waiting == 1
+	s.mu.Unlock()
+	if first {
+		releaseJobs(s.n)
+	}
+}
+
+// done takes the slots back, once no calls to Deps from the dependency are
+// waiting.
+func (s *jobSlots) done() {
+	s.mu.Lock()
+	s.waiting--
+	last := s.waiting == 0
+	s.mu.Unlock()
+	if last {
+		acquireJobs(s.n)
+	}
+}
+
+// yieldJobs gives up the job slots held by the dependency running with st
+// while it waits on the dependencies it started, and returns a function that
+// takes them back.  Otherwise a dependency that called Deps could wait forever
+// for a slot held by its own caller.  Calls made from outside a dependency,
+// such as by the target mage was asked to run, hold no slots to give up.
+func yieldJobs(st depState) (reclaim func()) {
+	if st.slots == nil {
+		return func() {}
+	}
+	st.slots.wait()
+	return st.slots.done
+}
+
+// semaphore is a weighted semaphore that hands out slots in the order they were
+// asked for, so that a request for many slots is not starved by requests for
+// fewer.
+type semaphore struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	size    int
+	used    int
+	next    int // the ticket given to the next caller of acquire
+	serving int // the ticket of the caller allowed to take slots next
+}
+
+func newSemaphore(size int) *semaphore {
+	s := &semaphore{size: size}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *semaphore) acquire(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket := s.next
+	s.next++
+	for ticket != s.serving || s.used+n > s.size {
+		s.cond.Wait()
+	}
+	s.used += n
+	s.serving++
+	s.cond.Broadcast()
+}
+
+func (s *semaphore) release(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	s.cond.Broadcast()
+}
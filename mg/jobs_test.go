@@ -0,0 +1,132 @@
+package mg
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withJobs limits the jobs run by the mg package to n until the returned
+// function is called.
+func withJobs(n int) (restore func()) {
+	jobsOnce.Do(func() {})
+	old := jobs
+	jobs = newSemaphore(n)
+	return func() { jobs = old }
+}
+
+// jobTracker records the most job slots used at the same time.
+type jobTracker struct {
+	mu   sync.Mutex
+	used int
+	max  int
+}
+
+func (j *jobTracker) work(name string, weight int) {
+	j.mu.Lock()
+	j.used += weight
+	if j.used > j.max {
+		j.max = j.used
+	}
+	j.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	j.mu.Lock()
+	j.used -= weight
+	j.mu.Unlock()
+}
+
+func TestJobs(t *testing.T) {
+	os.Setenv(JobsEnv, "3")
+	defer os.Unsetenv(JobsEnv)
+	if Jobs() != 3 {
+		t.Fatalf("expected 3 jobs, but got %v", Jobs())
+	}
+	os.Setenv(JobsEnv, "-1")
+	if Jobs() != 0 {
+		t.Fatalf("expected no limit on jobs, but got %v", Jobs())
+	}
+}
+
+func TestDepsJobsLimit(t *testing.T) {
+	defer withJobs(2)()
+	j := &jobTracker{}
+	var deps []interface{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		deps = append(deps, F(j.work, "limit-"+name, 1))
+	}
+	Deps(deps...)
+	if j.max != 2 {
+		t.Fatalf("expected at most 2 dependencies to run at once, but got %v", j.max)
+	}
+}
+
+func TestDepsJobsNested(t *testing.T) {
+	defer withJobs(1)()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Deps(nestedA)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("nested dependencies deadlocked waiting for a job slot")
+	}
+}
+
+func nestedA() { Deps(nestedB, nestedC) }
+
+func nestedB() { SerialDeps(nestedC) }
+
+func nestedC() {}
+
+func TestWeightedDeps(t *testing.T) {
+	defer withJobs(3)()
+	j := &jobTracker{}
+	heavy := func() {
+		WeightedDeps(2, F(j.work, "heavy-a", 2), F(j.work, "heavy-b", 2), F(j.work, "heavy-c", 2))
+	}
+	light := func() {
+		Deps(F(j.work, "light-a", 1), F(j.work, "light-b", 1), F(j.work, "light-c", 1))
+	}
+	Deps(heavy, light)
+	if j.max > 3 {
+		t.Fatalf("expected at most 3 job slots to be used at once, but got %v", j.max)
+	}
+}
+
+// a weighted dependency that starts weighted dependencies of its own, without
+// a context, must give back all the slots it holds while it waits on them.
+func TestWeightedDepsNested(t *testing.T) {
+	defer withJobs(2)()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		WeightedDeps(2, weightedOuter)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("nested weighted dependencies deadlocked waiting for job slots")
+	}
+}
+
+func weightedOuter() { WeightedDeps(2, weightedInner) }
+
+func weightedInner() {}
+
+func TestWeightedDepsOverLimit(t *testing.T) {
+	defer withJobs(1)()
+	j := &jobTracker{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		WeightedDeps(5, F(j.work, "over-a", 1))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dependency heavier than the job limit never ran")
+	}
+}
@@ -0,0 +1,111 @@
+package mg
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// PrefixEnv is the environment variable that indicates the user requested
+// that each line of output from commands be prefixed with the name of the
+// target or dependency that ran them.
+const PrefixEnv = "MAGEFILE_PREFIX"
+
+// BufferEnv is the environment variable that indicates the user requested
+// that the output of commands run by each dependency be held until the
+// dependency finishes, and then written all at once.
+const BufferEnv = "MAGEFILE_BUFFER"
+
+// TargetEnv is the environment variable the compiled magefile sets to the name
+// of the target it is running.
+const TargetEnv = "MAGEFILE_TARGET"
+
+// Prefix reports whether a magefile was run with the prefix flag.
+func Prefix() bool {
+	b, _ := strconv.ParseBool(os.Getenv(PrefixEnv))
+	return b
+}
+
+// Buffer reports whether a magefile was run with the buffer flag.
+func Buffer() bool {
+	b, _ := strconv.ParseBool(os.Getenv(BufferEnv))
+	return b
+}
+
+// CurrentTarget returns the name of the dependency running with ctx, the
+// context it was given.  If ctx isn't a dependency's, it returns the name of
+// the dependency running on the calling goroutine, or if there is none, the
+// name of the target being run.
+func CurrentTarget(ctx context.Context) string {
+	if dep := stateOf(ctx).dep; dep != "" {
+		return dep.getRun().name
+	}
+	return os.Getenv(TargetEnv)
+}
+
+// outputCtl keeps writes to the real stdout and stderr from different
+// goroutines from being mixed together.
+var outputCtl sync.Mutex
+
+// OutputTo returns a writer for output meant for w, usually os.Stdout or
+// os.Stderr, from the dependency running with ctx, the context it was given,
+// or if ctx isn't a dependency's, the dependency running on the calling
+// goroutine.  If the magefile was run with the buffer flag, what's written is
+// held until the dependency finishes.  Otherwise, or outside of a dependency,
+// it is written to w straight away.  Each call to Write is written to w in one
+// piece, so that writing a line at a time keeps lines from different
+// dependencies from being mixed.
+func OutputTo(ctx context.Context, w io.Writer) io.Writer {
+	if out := stateOf(ctx).out; out != nil {
+		return bufferedWriter{out: out, w: w}
+	}
+	return lockedWriter{w: w}
+}
+
+type lockedWriter struct {
+	w io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	outputCtl.Lock()
+	defer outputCtl.Unlock()
+	return l.w.Write(p)
+}
+
+// outputBuffer holds the output of a dependency, in the order it was written,
+// until the dependency finishes.
+type outputBuffer struct {
+	mu     sync.Mutex
+	chunks []outputChunk
+}
+
+type outputChunk struct {
+	w io.Writer
+	b []byte
+}
+
+// flush writes everything in the buffer to where it was meant for.
+func (o *outputBuffer) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	outputCtl.Lock()
+	defer outputCtl.Unlock()
+	for _, c := range o.chunks {
+		c.w.Write(c.b)
+	}
+	o.chunks = nil
+}
+
+type bufferedWriter struct {
+	out *outputBuffer
+	w   io.Writer
+}
+
+func (b bufferedWriter) Write(p []byte) (int, error) {
+	b.out.mu.Lock()
+	defer b.out.mu.Unlock()
+	b.out.chunks = append(b.out.chunks, outputChunk{w: b.w, b: append([]byte(nil), p...)})
+	return len(p), nil
+}
@@ -0,0 +1,66 @@
+package mg
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Retry returns a Dependency that runs fn, a target function as accepted by
+// Deps or a Dependency returned by F, and if it returns an error, runs it
+// again up to attempts times in all, waiting backoff before the first retry
+// and twice as long before each one after that.  This is useful for
+// dependencies that can fail for reasons outside of the build, such as
+// downloading modules or pulling images:
+//
+//     mg.Deps(mg.Retry(Download, 3, time.Second))
+//
+// The returned Dependency is separate from fn: passing fn to Deps elsewhere
+// runs it without retries, and only once, as usual.  Like any dependency, the
+// returned one is only run once per run of mage, however many times Retry is
+// called with the same arguments, so once all of its attempts have been used,
+// the last error is returned to everything that depends on it.  Retries stop
+// early if the context given to the dependency is cancelled.  Retry panics if
+// fn is not a target function or a Dependency returned by F.
+func Retry(fn interface{}, attempts int, backoff time.Duration) Dependency {
+	dep, err := makeDependency(fn)
+	if err != nil {
+		panic(Fatal(1, err.Error()))
+	}
+	var id targetDep
+	switch d := dep.(type) {
+	case targetDep:
+		id = d
+	case fnDep:
+		id = d.targetDep
+	default:
+		panic(Fatal(1, fmt.Sprintf("%T can't be retried, only target functions and dependencies returned by F can", fn)))
+	}
+	run := id.getRun()
+	retryID := fmt.Sprintf("%s retried %d times after %v", id, attempts, backoff)
+	retry := needTargetDep(retryID, run.name, func(ctx context.Context) error {
+		return retryCall(ctx, run, attempts, backoff)
+	})
+	if _, ok := dep.(fnDep); ok {
+		return fnDep{retry}
+	}
+	return retry
+}
+
+// retryCall calls the target run by run, retrying it as described for Retry.
+// It calls the target's function directly, leaving run itself alone.
+func retryCall(ctx context.Context, run *targetRun, attempts int, backoff time.Duration) error {
+	err := run.fn(ctx)
+	for i := 1; err != nil && i < attempts; i++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff << uint(i-1)):
+		}
+		if Verbose() {
+			logger.Printf("Retrying dependency: %s (attempt %d of %d) after error: %v", run.name, i+1, attempts, err)
+		}
+		err = run.fn(ctx)
+	}
+	return err
+}
@@ -0,0 +1,113 @@
+package mg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	runs := 0
+	download := func() error {
+		runs++
+		if runs < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}
+	start := time.Now()
+	Deps(Retry(download, 3, 10*time.Millisecond))
+	if runs != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs)
+	}
+	// the retries wait 10ms and then 20ms.
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("expected retries to back off, but they took %v", d)
+	}
+	// like any dependency, it only runs once.
+	Deps(Retry(download, 3, 10*time.Millisecond))
+	if runs != 3 {
+		t.Fatalf("expected dependency not to run again, got %d runs", runs)
+	}
+}
+
+func TestRetrySeparate(t *testing.T) {
+	runs := 0
+	fail := func() error {
+		runs++
+		return errors.New("oops")
+	}
+	plain, err := makeDependency(fail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.RunDependency(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if runs != 1 {
+		t.Fatalf("expected the plain dependency not to be retried, got %d runs", runs)
+	}
+	// retrying a dependency that has already run still retries it.
+	if err := Retry(fail, 3, time.Millisecond).RunDependency(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if runs != 4 {
+		t.Fatalf("expected 3 more runs, got %d runs", runs)
+	}
+	// each set of retries is separate, and doesn't change the others.
+	if err := Retry(fail, 2, time.Millisecond).RunDependency(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := plain.RunDependency(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	if runs != 6 {
+		t.Fatalf("expected 2 more runs, got %d runs", runs)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	runs := 0
+	fail := func(ctx context.Context, n int) error {
+		runs++
+		return Fatalf(n, "failed %d", runs)
+	}
+	dep := Retry(F(fail, 4), 2, time.Millisecond)
+	err := dep.RunDependency(context.Background())
+	if err == nil || err.Error() != "failed 2" {
+		t.Fatalf("expected error from the last attempt, got %v", err)
+	}
+	if code := ExitStatus(err); code != 4 {
+		t.Fatalf("expected exit status 4, got %d", code)
+	}
+	if runs != 2 {
+		t.Fatalf("expected 2 runs, got %d", runs)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	fail := func() error {
+		runs++
+		cancel()
+		return errors.New("oops")
+	}
+	err := Retry(fail, 5, time.Hour).RunDependency(ctx)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if runs != 1 {
+		t.Fatalf("expected no retries once cancelled, got %d runs", runs)
+	}
+}
+
+func TestRetryInvalid(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic for a dependency that can't be retried")
+		}
+	}()
+	Retry(File(func() {}, []string{"out"}), 2, time.Millisecond)
+}
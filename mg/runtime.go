@@ -27,6 +27,15 @@ const GoCmdEnv = "MAGEFILE_GOCMD"
 // to ignore the default target specified in the magefile.
 const IgnoreDefaultEnv = "MAGEFILE_IGNOREDEFAULT"
 
+// DryRunEnv is the environment variable that indicates the user requested a
+// dry run, which prints the targets, dependencies and commands that would be
+// run instead of running commands.
+const DryRunEnv = "MAGEFILE_DRYRUN"
+
+// MagefileDirEnv is the environment variable mage sets to the absolute path
+// of the directory holding the magefiles being run.
+const MagefileDirEnv = "MAGEFILE_DIR"
+
 // Verbose reports whether a magefile was run with the verbose flag.
 func Verbose() bool {
 	b, _ := strconv.ParseBool(os.Getenv(VerboseEnv))
@@ -48,6 +57,22 @@ func GoCmd() string {
 	return "go"
 }
 
+// DryRun reports whether a magefile was run with the dry run flag.  In a dry
+// run, dependencies print their names before running, and the functions in
+// the sh package print the commands they would run instead of running them.
+func DryRun() bool {
+	b, _ := strconv.ParseBool(os.Getenv(DryRunEnv))
+	return b
+}
+
+// MagefileDir returns the directory holding the magefiles being run, which
+// may not be the directory targets run in, if mage was run with -w.  It is
+// empty if the magefiles weren't run by mage, such as a binary built with
+// -compile.
+func MagefileDir() string {
+	return os.Getenv(MagefileDirEnv)
+}
+
 // IgnoreDefault reports whether the user has requested to ignore the default target
 // in the magefile.
 func IgnoreDefault() bool {
@@ -0,0 +1,93 @@
+package mg
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// traceEventsEnv is the environment variable that the compiled magefile sets,
+// when run with -timing or -trace, to its process ID and the descriptor of the
+// file dependencies should record how long they took in, separated by a colon.
+// Other processes that inherit the variable ignore it.
+const traceEventsEnv = "MAGEFILE_TRACE_EVENTS"
+
+// traceEvent is a complete event in the Chrome trace event format, which the
+// compiled magefile combines with the events for its targets.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`  // microseconds since the unix epoch
+	Dur  int64             `json:"dur"` // microseconds
+	Pid  int               `json:"pid"`
+	Tid  int64             `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+var (
+	traceCtl   sync.Mutex
+	traceTid   int64               // the last thread ID given to a dependency's event
+	traceFiles map[string]*os.File // by the value of traceEventsEnv
+)
+
+// traceFile returns the file to record events in, or nil if the compiled
+// magefile didn't ask for them.  It must be called with traceCtl held.
+func traceFile() *os.File {
+	val := os.Getenv(traceEventsEnv)
+	if f, ok := traceFiles[val]; ok {
+		return f
+	}
+	var f *os.File
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) == 2 && parts[0] == strconv.Itoa(os.Getpid()) {
+		if fd, err := strconv.ParseUint(parts[1], 10, 64); err == nil {
+			f = os.NewFile(uintptr(fd), "trace events")
+		}
+	}
+	// the file is kept, since it would close the descriptor when collected.
+	if traceFiles == nil {
+		traceFiles = map[string]*os.File{}
+	}
+	traceFiles[val] = f
+	return f
+}
+
+// recordTrace records that the named dependency ran from start until now,
+// ending with the given error, if the compiled magefile asked for it.
+func recordTrace(name string, start time.Time, err error) {
+	if os.Getenv(traceEventsEnv) == "" {
+		return
+	}
+	e := traceEvent{
+		Name: name,
+		Cat:  "dependency",
+		Ph:   "X",
+		Ts:   start.UnixNano() / int64(time.Microsecond),
+		Dur:  int64(time.Since(start) / time.Microsecond),
+		Pid:  os.Getpid(),
+		// each dependency gets a row of its own in the trace.
+		Tid: atomic.AddInt64(&traceTid, 1),
+	}
+	if err != nil {
+		e.Args = map[string]string{"error": err.Error()}
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	traceCtl.Lock()
+	defer traceCtl.Unlock()
+	f := traceFile()
+	if f == nil {
+		return
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logger.Println("error recording dependency timing:", err)
+	}
+}
@@ -0,0 +1,34 @@
+package mg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordTrace(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	defer os.Unsetenv(traceEventsEnv)
+
+	// a variable inherited from another process is ignored.
+	os.Setenv(traceEventsEnv, fmt.Sprintf("%d:%d", os.Getpid()+1, f.Fd()))
+	recordTrace("Other", time.Now(), nil)
+	os.Setenv(traceEventsEnv, fmt.Sprintf("%d:%d", os.Getpid(), f.Fd()))
+	recordTrace("Mine", time.Now(), nil)
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "Other") || !strings.Contains(string(b), `"name":"Mine"`) {
+		t.Fatalf("expected only the event recorded for this process, got %s", b)
+	}
+}
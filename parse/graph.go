@@ -0,0 +1,291 @@
+package parse
+
+import (
+	"go/ast"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/magefile/mage/internal"
+)
+
+const mgPath = "github.com/magefile/mage/mg"
+
+// depFuncs are the functions in the mg package that declare dependencies,
+// mapped to whether they run the dependencies serially.
+var depFuncs = map[string]bool{
+	"Deps":            false,
+	"CtxDeps":         false,
+	"SerialDeps":      true,
+	"SerialCtxDeps":   true,
+	"WeightedDeps":    false,
+	"WeightedCtxDeps": false,
+}
+
+// Graph is the graph of dependencies between the functions of a mage package,
+// found by examining the calls each function makes to mg.Deps, mg.CtxDeps,
+// mg.SerialDeps, mg.SerialCtxDeps, mg.WeightedDeps and mg.WeightedCtxDeps.
+type Graph struct {
+	Nodes []*Node `json:"nodes"`
+}
+
+// Node is a function in a dependency Graph.  Targets are named as they are on
+// the command line, other functions are named as they are declared.
+type Node struct {
+	Name   string `json:"name"`
+	Target bool   `json:"target"`
+	Deps   []Edge `json:"deps"`
+}
+
+// Edge is a dependency declared by a Node.  If the dependency could not be
+// resolved to a function in the graph, Name holds the source of the expression
+// passed as the dependency.
+type Edge struct {
+	Name     string `json:"name"`
+	Args     string `json:"args,omitempty"` // arguments given with mg.F
+	Serial   bool   `json:"serial"`
+	Resolved bool   `json:"resolved"`
+}
+
+// Node returns the node with the given name, or nil if there is none.
+func (g *Graph) Node(name string) *Node {
+	for _, n := range g.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// graphPkg is a package whose functions are being added to a dependency graph.
+type graphPkg struct {
+	info  *PkgInfo
+	name  string // the name used to qualify functions that aren't targets
+	funcs map[string]*ast.FuncDecl
+}
+
+// funcKey returns the key used to look up a function with an optional
+// receiver in graphPkg.funcs.
+func funcKey(recv, name string) string {
+	if recv == "" {
+		return name
+	}
+	return recv + "." + name
+}
+
+// DepGraph returns the dependency graph of the functions in the package and
+// the packages it imports with mage:import.
+func DepGraph(pi *PkgInfo) *Graph {
+	pkgs := []*graphPkg{newGraphPkg(pi, "")}
+	imports := map[string]*graphPkg{}
+	for _, imp := range pi.Imports {
+		info := imp.Info
+		gp := newGraphPkg(&info, imp.Name)
+		pkgs = append(pkgs, gp)
+		imports[imp.Name] = gp
+	}
+
+	nodes := map[string]*Node{}
+	used := map[string]bool{}
+	for _, gp := range pkgs {
+		for key, decl := range gp.funcs {
+			n := &Node{Name: gp.nodeName(key)}
+			n.Target = gp.target(key) != nil
+			nodes[n.Name] = n
+			mg := mgName(gp.info, decl)
+			if mg == "" || decl.Body == nil {
+				continue
+			}
+			ast.Inspect(decl.Body, func(node ast.Node) bool {
+				call, ok := node.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				serial, args, ok := depCall(call, mg)
+				if !ok {
+					return true
+				}
+				for _, arg := range args {
+					e := gp.edge(arg, mg, imports)
+					e.Serial = serial
+					if e.Resolved {
+						used[e.Name] = true
+					}
+					n.Deps = append(n.Deps, e)
+				}
+				return true
+			})
+		}
+	}
+
+	g := &Graph{}
+	for _, n := range nodes {
+		if n.Target || len(n.Deps) > 0 || used[n.Name] {
+			g.Nodes = append(g.Nodes, n)
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Name < g.Nodes[j].Name })
+	return g
+}
+
+func newGraphPkg(pi *PkgInfo, name string) *graphPkg {
+	gp := &graphPkg{info: pi, name: name, funcs: map[string]*ast.FuncDecl{}}
+	for _, decl := range pi.funcDecls {
+		recv := ""
+		if decl.Recv != nil && len(decl.Recv.List) == 1 {
+			id, ok := decl.Recv.List[0].Type.(*ast.Ident)
+			if !ok {
+				continue
+			}
+			recv = id.Name
+		}
+		gp.funcs[funcKey(recv, decl.Name.Name)] = decl
+	}
+	return gp
+}
+
+// target returns the target for the function with the given key, or nil if
+// the function is not a target.
+func (gp *graphPkg) target(key string) *Function {
+	for _, f := range gp.info.Funcs {
+		if funcKey(f.Receiver, f.Name) == key {
+			return f
+		}
+	}
+	return nil
+}
+
+// nodeName returns the name of the graph node for the function with the given
+// key.
+func (gp *graphPkg) nodeName(key string) string {
+	if f := gp.target(key); f != nil {
+		return internal.LowerFirst(f.TargetName())
+	}
+	if gp.name != "" {
+		return gp.name + "." + key
+	}
+	return key
+}
+
+// edge resolves a dependency passed to one of the mg dependency functions to
+// the node it refers to.
+func (gp *graphPkg) edge(dep ast.Expr, mg string, imports map[string]*graphPkg) Edge {
+	unresolved := Edge{Name: types.ExprString(dep)}
+	if call, ok := dep.(*ast.CallExpr); ok {
+		// mg.F(fn, args...)
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok || !isIdent(sel.X, mg) || sel.Sel.Name != "F" || len(call.Args) == 0 {
+			return unresolved
+		}
+		e := gp.edge(call.Args[0], mg, imports)
+		if !e.Resolved {
+			return unresolved
+		}
+		args := make([]string, 0, len(call.Args)-1)
+		for _, a := range call.Args[1:] {
+			args = append(args, types.ExprString(a))
+		}
+		e.Args = strings.Join(args, ", ")
+		return e
+	}
+
+	var pkg *graphPkg
+	var key string
+	switch v := dep.(type) {
+	case *ast.Ident:
+		pkg, key = gp, v.Name
+	case *ast.SelectorExpr:
+		switch x := v.X.(type) {
+		case *ast.Ident:
+			if imp, ok := imports[x.Name]; ok {
+				// imported.Func
+				pkg, key = imp, v.Sel.Name
+			} else {
+				// Namespace.Method
+				pkg, key = gp, funcKey(x.Name, v.Sel.Name)
+			}
+		case *ast.CompositeLit:
+			// Namespace{}.Method
+			id, ok := x.Type.(*ast.Ident)
+			if !ok {
+				return unresolved
+			}
+			pkg, key = gp, funcKey(id.Name, v.Sel.Name)
+		case *ast.SelectorExpr:
+			// imported.Namespace.Method
+			id, ok := x.X.(*ast.Ident)
+			if !ok {
+				return unresolved
+			}
+			imp, ok := imports[id.Name]
+			if !ok {
+				return unresolved
+			}
+			pkg, key = imp, funcKey(x.Sel.Name, v.Sel.Name)
+		default:
+			return unresolved
+		}
+	default:
+		return unresolved
+	}
+	if _, ok := pkg.funcs[key]; !ok {
+		return unresolved
+	}
+	return Edge{Name: pkg.nodeName(key), Resolved: true}
+}
+
+// depCall reports whether call is a call to one of the mg dependency
+// functions, and if so, whether it runs its dependencies serially and what
+// those dependencies are.
+func depCall(call *ast.CallExpr, mg string) (serial bool, deps []ast.Expr, ok bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || !isIdent(sel.X, mg) {
+		return false, nil, false
+	}
+	serial, ok = depFuncs[sel.Sel.Name]
+	if !ok {
+		return false, nil, false
+	}
+	deps = call.Args
+	if strings.Contains(sel.Sel.Name, "Ctx") && len(deps) > 0 {
+		// skip the context
+		deps = deps[1:]
+	}
+	if strings.HasPrefix(sel.Sel.Name, "Weighted") && len(deps) > 0 {
+		// skip the weight
+		deps = deps[1:]
+	}
+	return serial, deps, true
+}
+
+// mgName returns the name the mg package is imported as in the file that
+// declares decl, or "" if it is not imported.
+func mgName(pi *PkgInfo, decl *ast.FuncDecl) string {
+	// files occupy distinct ranges of positions, so the file declaring decl
+	// is the last one that starts before it.
+	var file *ast.File
+	for _, f := range pi.AstPkg.Files {
+		if f.Pos() <= decl.Pos() && (file == nil || f.Pos() > file.Pos()) {
+			file = f
+		}
+	}
+	if file != nil {
+		for _, imp := range file.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil || path != mgPath {
+				continue
+			}
+			if imp.Name != nil {
+				return imp.Name.Name
+			}
+			return "mg"
+		}
+	}
+	return ""
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
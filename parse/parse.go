@@ -7,11 +7,15 @@ import (
 	"go/doc"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/magefile/mage/internal"
 )
@@ -35,6 +39,9 @@ type PkgInfo struct {
 	DefaultFunc *Function
 	Aliases     map[string]*Function
 	Imports     []*Import
+	Watch       map[string][]string // file patterns for mage -watch, by lowercased target or alias
+
+	funcDecls []*ast.FuncDecl // all function declarations, including unexported ones
 }
 
 // Function represented a job function from a mage file
@@ -48,6 +55,42 @@ type Function struct {
 	IsContext  bool
 	Synopsis   string
 	Comment    string
+	Args       []Arg
+	Options    *Options
+	File       string // the file the function is declared in
+	Line       int    // the line the function is declared on
+}
+
+// Arg is a command line argument taken by a target function.
+type Arg struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// Options describes a struct argument taken by a target function, whose
+// fields are set from command line flags given after the target name.
+type Options struct {
+	Type  string // the name of the struct type in its package
+	Flags []Flag
+}
+
+// Flag is a command line flag that sets a field of a target's Options.  Fields
+// of an options struct are configured with struct tags:
+//
+//     type TestOpts struct {
+//         Race  bool   `flag:"race" help:"run tests with the race detector"`
+//         Count int    `default:"1" help:"number of times to run each test"`
+//         Skip  string `flag:"-"`
+//     }
+//
+// The flag name defaults to the field name with its first letter lowercased,
+// and a name of "-" means the field is not set from the command line.
+type Flag struct {
+	Name    string
+	Field   string
+	Type    string
+	Default string
+	Help    string
 }
 
 // ID returns user-readable information about where this function is defined.
@@ -78,7 +121,8 @@ func (f Function) TargetName() string {
 
 // ExecCode returns code for the template switch to run the target.
 // It wraps each target call to match the func(context.Context) error that
-// runTarget requires.
+// runTarget requires.  Any arguments the target takes are read from args.Args
+// starting at index x, which is advanced past them.
 func (f Function) ExecCode() (string, error) {
 	name := f.Name
 	if f.Receiver != "" {
@@ -88,41 +132,150 @@ func (f Function) ExecCode() (string, error) {
 		name = f.Package + "." + name
 	}
 
-	if f.IsContext && f.IsError {
-		out := `
-			wrapFn := func(ctx context.Context) error {
-				return %s(ctx)
-			}
-			err := runTarget(wrapFn)`[1:]
-		return fmt.Sprintf(out, name), nil
+	var parseargs string
+	if f.Options != nil {
+		parseargs += fmt.Sprintf(`
+			fs, opts := targetFlags[%q]()
+			fs.Parse(args.Args[x:])
+			x = len(args.Args) - fs.NArg()`, strings.ToLower(f.TargetName()))
 	}
-	if f.IsContext && !f.IsError {
-		out := `
-			wrapFn := func(ctx context.Context) error {
-				%s(ctx)
-				return nil
+	for x, arg := range f.Args {
+		conv, ok := argConverters[arg.Type]
+		if !ok {
+			return "", fmt.Errorf("unsupported argument type %s for %s", arg.Type, f.ID())
+		}
+		if conv == "" {
+			parseargs += fmt.Sprintf(`
+			arg%d := args.Args[x]
+			x++`, x)
+			continue
+		}
+		parseargs += fmt.Sprintf(`
+			arg%d, convErr := %s
+			if convErr != nil {
+				logger.Printf("invalid value %%q for argument <%s> of target %%q: expected %s\n", args.Args[x], %q)
+				os.Exit(2)
 			}
-			err := runTarget(wrapFn)`[1:]
-		return fmt.Sprintf(out, name), nil
+			x++`, x, fmt.Sprintf(conv, "args.Args[x]"), arg.Name, arg.Type, f.TargetName())
 	}
-	if !f.IsContext && f.IsError {
-		out := `
-			wrapFn := func(ctx context.Context) error {
-				return %s()
-			}
-			err := runTarget(wrapFn)`[1:]
-		return fmt.Sprintf(out, name), nil
+
+	params := make([]string, 0, len(f.Args)+1)
+	if f.IsContext {
+		params = append(params, "ctx")
+	}
+	for x := range f.Args {
+		params = append(params, fmt.Sprintf("arg%d", x))
 	}
-	if !f.IsContext && !f.IsError {
-		out := `
+	if f.Options != nil {
+		params = append(params, fmt.Sprintf("opts().(%s)", f.optionsType()))
+	}
+	call := name + "(" + strings.Join(params, ", ") + ")"
+
+	out := parseargs + `
 			wrapFn := func(ctx context.Context) error {
-				%s()
-				return nil
+				`
+	if f.IsError {
+		out += "return " + call
+	} else {
+		out += call + `
+				return nil`
+	}
+	out += fmt.Sprintf(`
 			}
-			err := runTarget(wrapFn)`[1:]
-		return fmt.Sprintf(out, name), nil
+			err := runTarget(%q, %v, wrapFn)`, f.TargetName(), f.IsContext)
+	return out[1:], nil
+}
+
+// FlagsCode returns code for a function that creates the flag set for a target
+// that takes an Options struct.  The function returns the flag set and a
+// function that returns the options once the flags have been parsed.
+func (f Function) FlagsCode() (string, error) {
+	if f.Options == nil {
+		return "", fmt.Errorf("%s does not take options", f.ID())
+	}
+	out := fmt.Sprintf(`func() (*flag.FlagSet, func() interface{}) {
+				opts := %s{}
+				fs := flag.NewFlagSet(%q, flag.ExitOnError)`, f.optionsType(), strings.ToLower(f.TargetName()))
+	for _, fl := range f.Options.Flags {
+		setter, ok := flagSetters[fl.Type]
+		if !ok {
+			return "", fmt.Errorf("unsupported flag type %s for %s", fl.Type, f.ID())
+		}
+		def, err := defaultCode(fl.Type, fl.Default)
+		if err != nil {
+			return "", fmt.Errorf("bad default for flag %s of %s: %v", fl.Name, f.ID(), err)
+		}
+		out += fmt.Sprintf(`
+				fs.%s(&opts.%s, %q, %s, %q)`, setter, fl.Field, fl.Name, def, fl.Help)
+	}
+	out += `
+				return fs, func() interface{} { return opts }
+			}`
+	return out, nil
+}
+
+// optionsType returns the name of the options struct as referenced from the
+// generated mainfile.
+func (f Function) optionsType() string {
+	if f.Package != "" {
+		return f.Package + "." + f.Options.Type
 	}
-	return "", fmt.Errorf("Error formatting ExecCode code for %#v", f)
+	return f.Options.Type
+}
+
+// argConverters maps each argument type a target may take to the code the
+// generated mainfile uses to convert a command line argument to that type.
+// Strings need no conversion.
+var argConverters = map[string]string{
+	"string":        "",
+	"int":           "strconv.Atoi(%s)",
+	"float64":       "strconv.ParseFloat(%s, 64)",
+	"bool":          "strconv.ParseBool(%s)",
+	"time.Duration": "time.ParseDuration(%s)",
+}
+
+// flagSetters maps each type an options field may have to the flag.FlagSet
+// method that defines a flag of that type.
+var flagSetters = map[string]string{
+	"string":        "StringVar",
+	"int":           "IntVar",
+	"float64":       "Float64Var",
+	"bool":          "BoolVar",
+	"time.Duration": "DurationVar",
+}
+
+// defaultCode returns the go literal for the default value of a flag of the
+// given type.
+func defaultCode(typ, val string) (string, error) {
+	switch typ {
+	case "string":
+		return strconv.Quote(val), nil
+	case "int":
+		if val == "" {
+			return "0", nil
+		}
+		i, err := strconv.Atoi(val)
+		return strconv.Itoa(i), err
+	case "float64":
+		if val == "" {
+			return "0", nil
+		}
+		f, err := strconv.ParseFloat(val, 64)
+		return strconv.FormatFloat(f, 'g', -1, 64), err
+	case "bool":
+		if val == "" {
+			return "false", nil
+		}
+		b, err := strconv.ParseBool(val)
+		return strconv.FormatBool(b), err
+	case "time.Duration":
+		if val == "" {
+			return "0", nil
+		}
+		d, err := time.ParseDuration(val)
+		return fmt.Sprintf("time.Duration(%d)", int64(d)), err
+	}
+	return "", fmt.Errorf("unsupported type %s", typ)
 }
 
 // PrimaryPackage parses a package.  If files is non-empty, it will only parse the files given.
@@ -138,6 +291,7 @@ func PrimaryPackage(gocmd, path string, files []string) (*PkgInfo, error) {
 
 	setDefault(info)
 	setAliases(info)
+	setWatch(info)
 	return info, nil
 }
 
@@ -193,15 +347,27 @@ func Package(path string, files []string) (*PkgInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	p := doc.New(pkg, "./", 0)
+	// doc.New removes unexported declarations from the AST, so grab all the
+	// functions first for DepGraph, and preserve the AST so their bodies are
+	// kept.
+	var decls []*ast.FuncDecl
+	for _, f := range pkg.Files {
+		for _, d := range f.Decls {
+			if decl, ok := d.(*ast.FuncDecl); ok {
+				decls = append(decls, decl)
+			}
+		}
+	}
+	p := doc.New(pkg, "./", doc.PreserveAST)
 	pi := &PkgInfo{
 		AstPkg:      pkg,
 		DocPkg:      p,
 		Description: toOneLine(p.Doc),
+		funcDecls:   decls,
 	}
 
-	setNamespaces(pi)
-	setFuncs(pi)
+	setNamespaces(pi, fset)
+	setFuncs(pi, fset)
 
 	hasDupes, names := checkDupeTargets(pi)
 	if hasDupes {
@@ -261,7 +427,7 @@ type Import struct {
 	Info       PkgInfo
 }
 
-func setFuncs(pi *PkgInfo) {
+func setFuncs(pi *PkgInfo, fset *token.FileSet) {
 	for _, f := range pi.DocPkg.Funcs {
 		if f.Recv != "" {
 			debug.Printf("skipping method %s.%s", f.Recv, f.Name)
@@ -273,14 +439,19 @@ func setFuncs(pi *PkgInfo) {
 			// skip non-exported functions
 			continue
 		}
-		if typ := funcType(f.Decl.Type); typ != invalidType {
+		if typ, args, opts := targetType(pi, f.Decl.Type); typ != invalidType {
 			debug.Printf("found target %v", f.Name)
+			pos := fset.Position(f.Decl.Pos())
 			pi.Funcs = append(pi.Funcs, &Function{
 				Name:      f.Name,
 				Comment:   toOneLine(f.Doc),
 				Synopsis:  sanitizeSynopsis(f),
 				IsError:   typ == errorType || typ == contextErrorType,
 				IsContext: typ == contextVoidType || typ == contextErrorType,
+				Args:      args,
+				Options:   opts,
+				File:      pos.Filename,
+				Line:      pos.Line,
 			})
 		} else {
 			debug.Printf("skipping function with invalid signature func %s(%v)(%v)", f.Name, fieldNames(f.Decl.Type.Params), fieldNames(f.Decl.Type.Results))
@@ -288,7 +459,7 @@ func setFuncs(pi *PkgInfo) {
 	}
 }
 
-func setNamespaces(pi *PkgInfo) {
+func setNamespaces(pi *PkgInfo, fset *token.FileSet) {
 	for _, t := range pi.DocPkg.Types {
 		if !isNamespace(t) {
 			continue
@@ -298,11 +469,12 @@ func setNamespaces(pi *PkgInfo) {
 			if !ast.IsExported(f.Name) {
 				continue
 			}
-			typ := funcType(f.Decl.Type)
+			typ, args, opts := targetType(pi, f.Decl.Type)
 			if typ == invalidType {
 				continue
 			}
 			debug.Printf("found namespace method %s %s.%s", pi.DocPkg.ImportPath, t.Name, f.Name)
+			pos := fset.Position(f.Decl.Pos())
 			pi.Funcs = append(pi.Funcs, &Function{
 				Name:      f.Name,
 				Receiver:  t.Name,
@@ -310,6 +482,10 @@ func setNamespaces(pi *PkgInfo) {
 				Synopsis:  sanitizeSynopsis(f),
 				IsError:   typ == errorType || typ == contextErrorType,
 				IsContext: typ == contextVoidType || typ == contextErrorType,
+				Args:      args,
+				Options:   opts,
+				File:      pos.Filename,
+				Line:      pos.Line,
 			})
 		}
 	}
@@ -510,6 +686,14 @@ func setDefault(pi *PkgInfo) {
 				log.Println("warning, default declaration malformed:", err)
 				return
 			}
+			if len(f.Args) > 0 {
+				log.Printf("warning, default target %s takes arguments and will be ignored", f.TargetName())
+				return
+			}
+			if f.Options != nil {
+				log.Printf("warning, default target %s takes options and will be ignored", f.TargetName())
+				return
+			}
 			pi.DefaultFunc = f
 			return
 		}
@@ -572,6 +756,90 @@ func setAliases(pi *PkgInfo) {
 	}
 }
 
+// setWatch reads the file patterns declared for mage -watch from a variable
+// like this:
+//
+//     var Watch = map[string][]string{
+//         "test": {"**/*.go", "go.mod"},
+//     }
+func setWatch(pi *PkgInfo) {
+	for _, v := range pi.DocPkg.Vars {
+		for _, name := range v.Names {
+			if name != "Watch" {
+				continue
+			}
+			spec, x := valueSpec(v.Decl, name)
+			if spec == nil {
+				log.Println("warning: watch declaration is not a value")
+				return
+			}
+			if len(spec.Values) != len(spec.Names) {
+				log.Println("warning: watch declaration does not have a single value")
+				return
+			}
+			comp, ok := spec.Values[x].(*ast.CompositeLit)
+			if !ok {
+				log.Println("warning: watch declaration is not a map")
+				return
+			}
+			pi.Watch = map[string][]string{}
+			for _, elem := range comp.Elts {
+				kv, ok := elem.(*ast.KeyValueExpr)
+				if !ok {
+					log.Printf("warning: watch declaration %q is not a map element", types.ExprString(elem))
+					continue
+				}
+				k, ok := kv.Key.(*ast.BasicLit)
+				if !ok || k.Kind != token.STRING {
+					log.Printf("warning: watch key is not a string literal %q", types.ExprString(kv.Key))
+					continue
+				}
+				target, ok := lit2string(k)
+				if !ok {
+					log.Println("warning: malformed target name for watch", types.ExprString(kv.Key))
+					continue
+				}
+				patterns, ok := kv.Value.(*ast.CompositeLit)
+				if !ok {
+					log.Printf("warning: watch patterns for %q are not a slice", target)
+					continue
+				}
+				for _, p := range patterns.Elts {
+					lit, ok := p.(*ast.BasicLit)
+					if !ok || lit.Kind != token.STRING {
+						log.Printf("warning: watch pattern for %q is not a string literal %q", target, types.ExprString(p))
+						continue
+					}
+					s, err := strconv.Unquote(lit.Value)
+					if err != nil {
+						log.Printf("warning: malformed watch pattern for %q: %v", target, err)
+						continue
+					}
+					pi.Watch[strings.ToLower(target)] = append(pi.Watch[strings.ToLower(target)], s)
+				}
+			}
+			return
+		}
+	}
+}
+
+// valueSpec returns the spec in decl that declares name, and the index of name
+// in it, or nil if there isn't one.
+func valueSpec(decl *ast.GenDecl, name string) (*ast.ValueSpec, int) {
+	for _, s := range decl.Specs {
+		spec, ok := s.(*ast.ValueSpec)
+		if !ok {
+			continue
+		}
+		for i, n := range spec.Names {
+			if n.Name == name {
+				return spec, i
+			}
+		}
+	}
+	return nil, 0
+}
+
 func getFunction(exp ast.Expr, pi *PkgInfo) (*Function, error) {
 
 	// selector expressions are in LIFO format.
@@ -681,11 +949,18 @@ func getPackage(path string, files []string, fset *token.FileSet) (*ast.Package,
 }
 
 func hasContextParam(ft *ast.FuncType) bool {
-	if ft.Params.NumFields() != 1 {
+	if ft.Params.NumFields() < 1 {
 		return false
 	}
 	ret := ft.Params.List[0]
-	sel, ok := ret.Type.(*ast.SelectorExpr)
+	if len(ret.Names) > 1 {
+		return false
+	}
+	return isContextType(ret.Type)
+}
+
+func isContextType(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
 	if !ok {
 		return false
 	}
@@ -699,6 +974,49 @@ func hasContextParam(ft *ast.FuncType) bool {
 	return sel.Sel.Name == "Context"
 }
 
+// argType returns the name of the type of a target argument, or "" if the type
+// is not one that can be parsed from the command line.
+func argType(e ast.Expr) string {
+	var name string
+	switch t := e.(type) {
+	case *ast.Ident:
+		name = t.Name
+	case *ast.SelectorExpr:
+		pkg, ok := t.X.(*ast.Ident)
+		if !ok {
+			return ""
+		}
+		name = pkg.Name + "." + t.Sel.Name
+	default:
+		return ""
+	}
+	if _, ok := argConverters[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+// funcArgs returns the command line arguments declared by the parameters of
+// ft, skipping the first skip fields.  It reports false if any parameter is
+// not of a type mage can parse from the command line.
+func funcArgs(ft *ast.FuncType, skip int) ([]Arg, bool) {
+	var args []Arg
+	for _, field := range ft.Params.List[skip:] {
+		typ := argType(field.Type)
+		if typ == "" {
+			return nil, false
+		}
+		if len(field.Names) == 0 {
+			args = append(args, Arg{Name: fmt.Sprintf("arg%d", len(args)), Type: typ})
+			continue
+		}
+		for _, n := range field.Names {
+			args = append(args, Arg{Name: n.Name, Type: typ})
+		}
+	}
+	return args, true
+}
+
 func hasVoidReturn(ft *ast.FuncType) bool {
 	res := ft.Results
 	return res.NumFields() == 0
@@ -726,24 +1044,126 @@ const (
 	contextErrorType
 )
 
-func funcType(ft *ast.FuncType) functype {
-	if hasContextParam(ft) {
-		if hasVoidReturn(ft) {
-			return contextVoidType
-		}
-		if hasErrorReturn(ft) {
-			return contextErrorType
+// funcType reports the kind of target function ft describes, along with any
+// command line arguments it takes after its optional context argument.
+func funcType(ft *ast.FuncType) (functype, []Arg) {
+	skip := 0
+	isContext := hasContextParam(ft)
+	if isContext {
+		skip = 1
+	}
+	args, ok := funcArgs(ft, skip)
+	if !ok {
+		return invalidType, nil
+	}
+	switch {
+	case isContext && hasVoidReturn(ft):
+		return contextVoidType, args
+	case isContext && hasErrorReturn(ft):
+		return contextErrorType, args
+	case hasVoidReturn(ft):
+		return voidType, args
+	case hasErrorReturn(ft):
+		return errorType, args
+	}
+	return invalidType, nil
+}
+
+// targetType is like funcType, but also allows the last parameter of the
+// function to be an options struct declared in the package.
+func targetType(pi *PkgInfo, ft *ast.FuncType) (functype, []Arg, *Options) {
+	n := ft.Params.NumFields()
+	if n == 0 {
+		typ, args := funcType(ft)
+		return typ, args, nil
+	}
+	last := ft.Params.List[len(ft.Params.List)-1]
+	id, ok := last.Type.(*ast.Ident)
+	if !ok || len(last.Names) > 1 {
+		typ, args := funcType(ft)
+		return typ, args, nil
+	}
+	st := findStruct(pi, id.Name)
+	if st == nil {
+		typ, args := funcType(ft)
+		return typ, args, nil
+	}
+	opts, err := structOptions(id.Name, st)
+	if err != nil {
+		log.Printf("warning: ignoring target with invalid options struct %s: %v", id.Name, err)
+		return invalidType, nil, nil
+	}
+	params := *ft.Params
+	params.List = params.List[:len(params.List)-1]
+	short := *ft
+	short.Params = &params
+	typ, args := funcType(&short)
+	if typ == invalidType {
+		return invalidType, nil, nil
+	}
+	return typ, args, opts
+}
+
+// findStruct returns the struct type declared in the package with the given
+// name, or nil if there is none.
+func findStruct(pi *PkgInfo, name string) *ast.StructType {
+	for _, f := range pi.AstPkg.Files {
+		for _, d := range f.Decls {
+			gen, ok := d.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if ts.Name.Name != name {
+					continue
+				}
+				st, _ := ts.Type.(*ast.StructType)
+				return st
+			}
 		}
 	}
-	if ft.Params.NumFields() == 0 {
-		if hasVoidReturn(ft) {
-			return voidType
+	return nil
+}
+
+// structOptions returns the flags declared by the exported fields of st.
+func structOptions(name string, st *ast.StructType) (*Options, error) {
+	opts := &Options{Type: name}
+	for _, field := range st.Fields.List {
+		var tag reflect.StructTag
+		if field.Tag != nil {
+			s, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(s)
 		}
-		if hasErrorReturn(ft) {
-			return errorType
+		for _, n := range field.Names {
+			if !ast.IsExported(n.Name) || tag.Get("flag") == "-" {
+				continue
+			}
+			typ := argType(field.Type)
+			if typ == "" {
+				return nil, fmt.Errorf("field %s has unsupported type %s", n.Name, field.Type)
+			}
+			fl := Flag{
+				Name:    tag.Get("flag"),
+				Field:   n.Name,
+				Type:    typ,
+				Default: tag.Get("default"),
+				Help:    tag.Get("help"),
+			}
+			if fl.Name == "" {
+				r := []rune(n.Name)
+				fl.Name = string(unicode.ToLower(r[0])) + string(r[1:])
+			}
+			if _, err := defaultCode(fl.Type, fl.Default); err != nil {
+				return nil, fmt.Errorf("field %s has invalid default %q: %v", n.Name, fl.Default, err)
+			}
+			opts.Flags = append(opts.Flags, fl)
 		}
 	}
-	return invalidType
+	return opts, nil
 }
 
 func toOneLine(s string) string {
@@ -17,35 +17,49 @@ func TestParse(t *testing.T) {
 			IsError:  true,
 			Comment:  "Synopsis for \"returns\" error. And some more text.",
 			Synopsis: `Synopsis for "returns" error.`,
+			File:     "testdata/func.go",
+			Line:     9,
 		},
 		{
 			Name: "ReturnsVoid",
+			File: "testdata/command.go",
+			Line: 21,
 		},
 		{
 			Name:      "TakesContextReturnsError",
 			IsError:   true,
 			IsContext: true,
+			File:      "testdata/command.go",
+			Line:      31,
 		},
 		{
 			Name:      "TakesContextReturnsVoid",
 			IsError:   false,
 			IsContext: true,
+			File:      "testdata/command.go",
+			Line:      27,
 		},
 		{
 			Name:     "RepeatingSynopsis",
 			IsError:  true,
 			Comment:  "RepeatingSynopsis chops off the repeating function name. Some more text.",
 			Synopsis: "chops off the repeating function name.",
+			File:     "testdata/repeating_synopsis.go",
+			Line:     7,
 		},
 		{
 			Name:     "Foobar",
 			Receiver: "Build",
 			IsError:  true,
+			File:     "testdata/subcommands.go",
+			Line:     9,
 		},
 		{
 			Name:     "Baz",
 			Receiver: "Build",
 			IsError:  false,
+			File:     "testdata/subcommands.go",
+			Line:     14,
 		},
 	}
 
@@ -94,3 +108,122 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseArgs(t *testing.T) {
+	info, err := PrimaryPackage("go", "./testdata", []string{"args.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Function{
+		{
+			Name:      "TakesArgs",
+			IsError:   true,
+			IsContext: true,
+			Args: []Arg{
+				{Name: "name", Type: "string"},
+				{Name: "count", Type: "int"},
+				{Name: "force", Type: "bool"},
+			},
+			File: "testdata/args.go",
+			Line: 10,
+		},
+		{
+			Name: "TakesDuration",
+			Args: []Arg{
+				{Name: "d", Type: "time.Duration"},
+				{Name: "ratio", Type: "float64"},
+			},
+			File: "testdata/args.go",
+			Line: 14,
+		},
+	}
+	if len(info.Funcs) != len(expected) {
+		t.Fatalf("expected %d targets, but got %#v", len(expected), info.Funcs)
+	}
+	for i, fn := range expected {
+		if !reflect.DeepEqual(fn, *info.Funcs[i]) {
+			t.Errorf("expected:\n%#v\n\ngot:\n%#v", fn, *info.Funcs[i])
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	info, err := PrimaryPackage("go", "./testdata", []string{"options.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Function{
+		{
+			Name: "TakesOptions",
+			Args: []Arg{{Name: "name", Type: "string"}},
+			Options: &Options{
+				Type: "BuildOpts",
+				Flags: []Flag{
+					{Name: "race", Field: "Race", Type: "bool", Help: "enable the race detector"},
+					{Name: "count", Field: "Count", Type: "int", Default: "3"},
+				},
+			},
+			File: "testdata/options.go",
+			Line: 12,
+		},
+	}
+	if !reflect.DeepEqual(expected, info.Funcs) {
+		t.Fatalf("expected:\n%#v\n\ngot:\n%#v", expected[0], info.Funcs)
+	}
+}
+
+func TestParseDefaultOptions(t *testing.T) {
+	info, err := PrimaryPackage("go", "./testdata", []string{"default_options.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DefaultFunc != nil {
+		t.Fatalf("expected a default target that takes options to be ignored, got %v", info.DefaultFunc.TargetName())
+	}
+	if len(info.Funcs) != 1 || info.Funcs[0].Name != "Test" {
+		t.Fatalf("expected Test to still be a target, got %v", info.Funcs)
+	}
+}
+
+func TestParseWatch(t *testing.T) {
+	info, err := PrimaryPackage("go", "./testdata", []string{"watch.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{"build": {"**/*.go", "go.mod"}}
+	if !reflect.DeepEqual(expected, info.Watch) {
+		t.Fatalf("expected %v, got %v", expected, info.Watch)
+	}
+
+	info, err = PrimaryPackage("go", "./testdata", []string{"watch_novalue.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Watch != nil {
+		t.Fatalf("expected no watch patterns for a declaration without a value, got %v", info.Watch)
+	}
+}
+
+func TestDepGraph(t *testing.T) {
+	info, err := PrimaryPackage("go", "./testdata", []string{"command.go", "func.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := DepGraph(info)
+	expected := &Graph{
+		Nodes: []*Node{
+			{Name: "f"},
+			{Name: "returnsNilError", Target: true},
+			{Name: "returnsVoid", Target: true, Deps: []Edge{{Name: "f", Resolved: true}}},
+			{Name: "takesContextReturnsError", Target: true},
+			{Name: "takesContextReturnsVoid", Target: true},
+		},
+	}
+	if !reflect.DeepEqual(g, expected) {
+		for _, n := range g.Nodes {
+			t.Logf("%#v", n)
+		}
+		t.Fatal("unexpected graph")
+	}
+}
@@ -0,0 +1,17 @@
+// +build mage
+
+package main
+
+import (
+	"context"
+	"time"
+)
+
+func TakesArgs(ctx context.Context, name string, count int, force bool) error {
+	return nil
+}
+
+func TakesDuration(d time.Duration, ratio float64) {}
+
+// this should not be a target because it takes a slice
+func TakesSlice(names []string) {}
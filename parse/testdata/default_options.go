@@ -0,0 +1,12 @@
+// +build mage
+
+package main
+
+// this should not be the default target because it takes options
+var Default = Test
+
+type TestOpts struct {
+	Race bool
+}
+
+func Test(opts TestOpts) {}
@@ -0,0 +1,19 @@
+// +build mage
+
+package main
+
+type BuildOpts struct {
+	Race   bool   `flag:"race" help:"enable the race detector"`
+	Count  int    `default:"3"`
+	hidden string
+	Skip   string `flag:"-"`
+}
+
+func TakesOptions(name string, opts BuildOpts) {}
+
+type BadOpts struct {
+	Count int `default:"three"`
+}
+
+// this should not be a target because its options have an invalid default
+func TakesBadOptions(opts BadOpts) {}
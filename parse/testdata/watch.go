@@ -0,0 +1,12 @@
+// +build mage
+
+package main
+
+var (
+	Other = map[string][]string{"other": {"nope"}}
+	Watch = map[string][]string{
+		"build": {"**/*.go", "go.mod"},
+	}
+)
+
+func Build() {}
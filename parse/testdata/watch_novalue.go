@@ -0,0 +1,7 @@
+// +build mage
+
+package main
+
+var Watch map[string][]string
+
+func Build() {}
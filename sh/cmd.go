@@ -2,16 +2,26 @@ package sh
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/magefile/mage/internal"
 	"github.com/magefile/mage/mg"
 )
 
+// planOut is where commands are printed instead of being run in a dry run.
+var planOut io.Writer = os.Stdout
+
+// killGrace is how long a command has to exit after its context is cancelled
+// before it is killed.
+var killGrace = 5 * time.Second
+
 // RunCmd returns a function that will call Run with the given command. This is
 // useful for creating command aliases to make your scripts easier to read, like
 // this:
@@ -50,6 +60,16 @@ func Run(cmd string, args ...string) error {
 	return RunWith(nil, cmd, args...)
 }
 
+// RunCtx is like Run, but stops the command if ctx is cancelled.  See ExecCtx.
+func RunCtx(ctx context.Context, cmd string, args ...string) error {
+	var output io.Writer
+	if mg.Verbose() {
+		output = os.Stdout
+	}
+	_, err := ExecCtx(ctx, nil, output, os.Stderr, cmd, args...)
+	return err
+}
+
 // RunV is like Run, but always sends the command's stdout to os.Stdout.
 func RunV(cmd string, args ...string) error {
 	_, err := Exec(nil, os.Stdout, os.Stderr, cmd, args...)
@@ -76,6 +96,14 @@ func Output(cmd string, args ...string) (string, error) {
 	return strings.TrimSuffix(buf.String(), "\n"), err
 }
 
+// OutputCtx is like Output, but stops the command if ctx is cancelled.  See
+// ExecCtx.
+func OutputCtx(ctx context.Context, cmd string, args ...string) (string, error) {
+	buf := &bytes.Buffer{}
+	_, err := ExecCtx(ctx, nil, buf, os.Stderr, cmd, args...)
+	return strings.TrimSuffix(buf.String(), "\n"), err
+}
+
 // OutputWith is like RunWith, but returns what is written to stdout.
 func OutputWith(env map[string]string, cmd string, args ...string) (string, error) {
 	buf := &bytes.Buffer{}
@@ -95,40 +123,113 @@ func OutputWith(env map[string]string, cmd string, args ...string) (string, erro
 // Ran reports if the command ran (rather than was not found or not executable).
 // Code reports the exit code the command returned if it ran. If err == nil, ran
 // is always true and code is always 0.
+//
+// In a dry run (see mg.DryRun), the expanded command is printed to stdout
+// instead of being run, and Exec reports that it ran successfully.
 func Exec(env map[string]string, stdout, stderr io.Writer, cmd string, args ...string) (ran bool, err error) {
-	expand := func(s string) string {
-		s2, ok := env[s]
-		if ok {
-			return s2
+	return ExecCtx(context.Background(), env, stdout, stderr, cmd, args...)
+}
+
+// ExecCtx is like Exec, but stops the command if ctx is cancelled before it
+// finishes, such as when mage is interrupted or its timeout (-t) runs out.  The
+// command is run in its own process group, so that any processes it starts are
+// stopped along with it, unless its stdin is a terminal, since it couldn't
+// read from the terminal from another group.  When ctx is cancelled, the
+// command and its process group are sent SIGTERM, and then SIGKILL if they
+// haven't exited within killGrace.  On Windows, the command is killed straight
+// away.  The error returned for a command that was stopped includes the reason
+// ctx was cancelled.
+func ExecCtx(ctx context.Context, env map[string]string, stdout, stderr io.Writer, cmd string, args ...string) (ran bool, err error) {
+	c := &Cmd{
+		ctx:    ctx,
+		name:   cmd,
+		args:   args,
+		env:    env,
+		stdin:  os.Stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	return c.exec(func() {})
+}
+
+// runCmd runs c, stopping it and the processes it started if ctx is cancelled.
+func runCmd(ctx context.Context, c *exec.Cmd) error {
+	return runCmds(ctx, []*exec.Cmd{c}, nil)[0]
+}
+
+// runCmds runs cmds at the same time and returns the error from each.  The
+// files in closeAfterStart, which are the ends of the pipes between the
+// commands, are closed once the commands have started.  If ctx is cancelled,
+// the commands and the processes they started are stopped.
+func runCmds(ctx context.Context, cmds []*exec.Cmd, closeAfterStart []io.Closer) []error {
+	errs := make([]error, len(cmds))
+	started := make([]bool, len(cmds))
+	for i, c := range cmds {
+		if ctx.Done() != nil {
+			internal.SetProcessGroup(c)
 		}
-		return os.Getenv(s)
+		errs[i] = c.Start()
+		started[i] = errs[i] == nil
 	}
-	cmd = os.Expand(cmd, expand)
-	for i := range args {
-		args[i] = os.Expand(args[i], expand)
+	for _, c := range closeAfterStart {
+		c.Close()
 	}
-	ran, code, err := run(env, stdout, stderr, cmd, args...)
-	if err == nil {
-		return true, nil
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i, c := range cmds {
+			if started[i] {
+				errs[i] = c.Wait()
+			}
+		}
+	}()
+	signal := func(f func(*exec.Cmd) error) {
+		for i, c := range cmds {
+			if started[i] {
+				f(c)
+			}
+		}
+	}
+	select {
+	case <-done:
+		return errs
+	case <-ctx.Done():
+	}
+	signal(internal.TerminateProcessGroup)
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		signal(internal.KillProcessGroup)
+		<-done
+	}
+	return errs
+}
+
+// formatCmd formats a command the way it would be typed into a shell, preceded
+// by the environment variables it overrides.
+func formatCmd(env map[string]string, cmd string, args []string) string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	words := make([]string, 0, len(keys)+len(args)+1)
+	for _, k := range keys {
+		words = append(words, k+"="+quote(env[k]))
 	}
-	if ran {
-		return ran, mg.Fatalf(code, `running "%s %s" failed with exit code %d`, cmd, strings.Join(args, " "), code)
+	words = append(words, quote(cmd))
+	for _, arg := range args {
+		words = append(words, quote(arg))
 	}
-	return ran, fmt.Errorf(`failed to run "%s %s: %v"`, cmd, strings.Join(args, " "), err)
+	return strings.Join(words, " ")
 }
 
-func run(env map[string]string, stdout, stderr io.Writer, cmd string, args ...string) (ran bool, code int, err error) {
-	c := exec.Command(cmd, args...)
-	c.Env = os.Environ()
-	for k, v := range env {
-		c.Env = append(c.Env, k+"="+v)
+// quote quotes s if it would not be read as a single word by a shell.
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n'\"\\$`") {
+		return fmt.Sprintf("%q", s)
 	}
-	c.Stderr = stderr
-	c.Stdout = stdout
-	c.Stdin = os.Stdin
-	log.Println("exec:", cmd, strings.Join(args, " "))
-	err = c.Run()
-	return CmdRan(err), ExitStatus(err), err
+	return s
 }
 
 // CmdRan examines the error to determine if it was generated as a result of a
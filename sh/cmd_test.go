@@ -2,8 +2,13 @@ package sh
 
 import (
 	"bytes"
+	"context"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/magefile/mage/mg"
 )
 
 func TestOutCmd(t *testing.T) {
@@ -70,3 +75,70 @@ func TestAutoExpand(t *testing.T) {
 	}
 
 }
+
+func TestDryRun(t *testing.T) {
+	os.Setenv(mg.DryRunEnv, "1")
+	defer os.Unsetenv(mg.DryRunEnv)
+	buf := &bytes.Buffer{}
+
+	defaultOut := planOut
+	planOut = buf
+	defer func() { planOut = defaultOut }()
+
+	out, err := OutputWith(map[string]string{"B": "two words", "A": "1"}, "thiswontwork", "$A", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if out != "" {
+		t.Errorf("expected no output, but got %q", out)
+	}
+	expected := "exec: A=1 B=\"two words\" thiswontwork 1 \"\"\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, but got %q", expected, buf)
+	}
+}
+
+func TestExecCtxCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ExecCtx(ctx, nil, nil, nil, os.Args[0], "-helper", "-sleep", "10s")
+	if err == nil {
+		t.Fatal("expected error for cancelled command")
+	}
+	if !strings.Contains(err.Error(), "was stopped: context deadline exceeded") {
+		t.Fatalf("expected error to say why the command was stopped, got %q", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected command to be stopped when cancelled, but it took %v", d)
+	}
+}
+
+func TestExecCtxKill(t *testing.T) {
+	defaultGrace := killGrace
+	killGrace = 100 * time.Millisecond
+	defer func() { killGrace = defaultGrace }()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	err := RunCtx(ctx, os.Args[0], "-helper", "-noTerm", "-sleep", "10s")
+	if err == nil {
+		t.Fatal("expected error for cancelled command")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected command ignoring SIGTERM to be killed, but it took %v", d)
+	}
+}
+
+func TestOutputCtx(t *testing.T) {
+	s, err := OutputCtx(context.Background(), os.Args[0], "-printArgs", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "[foo]" {
+		t.Fatalf("expected %q, got %q", "[foo]", s)
+	}
+}
@@ -0,0 +1,376 @@
+package sh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/magefile/mage/mg"
+)
+
+// Cmd is a command to run, for when the functions like Run and Exec don't give
+// enough control over how it's run.  Create one with Command, set it up with
+// its methods, which each return the Cmd so that they can be chained, and then
+// run it with Run, Output or Capture:
+//
+//  err := sh.Command("go", "test", "./...").
+//      Dir("api").
+//      Env("CGO_ENABLED", "0").
+//      Timeout(5 * time.Minute).
+//      Run()
+//
+// Unless they are changed, the command inherits mage's environment, reads
+// from mage's stdin, writes its stderr to mage's stderr, and writes its stdout
+// to mage's stdout if mage was run with -v, just like Run.  As with Exec, the
+// command and its arguments may refer to environment variables in $FOO format,
+// and a command that fails returns an error that will make mage exit with the
+// same code.
+type Cmd struct {
+	ctx      context.Context
+	name     string
+	args     []string
+	dir      string
+	env      map[string]string
+	clearEnv bool
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	timeout  time.Duration
+
+	attempts   int
+	retryDelay time.Duration
+	retryCodes []int
+	retryIf    *regexp.Regexp
+}
+
+// Command returns a Cmd that runs cmd with the given arguments.
+func Command(cmd string, args ...string) *Cmd {
+	var stdout io.Writer
+	if mg.Verbose() {
+		stdout = os.Stdout
+	}
+	return &Cmd{
+		ctx:        context.Background(),
+		name:       cmd,
+		args:       append([]string(nil), args...),
+		stdin:      os.Stdin,
+		stdout:     stdout,
+		stderr:     os.Stderr,
+		retryDelay: time.Second,
+	}
+}
+
+// Args adds arguments to the command.
+func (c *Cmd) Args(args ...string) *Cmd {
+	c.args = append(c.args, args...)
+	return c
+}
+
+// Dir sets the directory the command is run in.  By default it's the current
+// directory.
+func (c *Cmd) Dir(dir string) *Cmd {
+	c.dir = dir
+	return c
+}
+
+// Env sets an environment variable for the command, overriding the value it
+// has in mage's environment.
+func (c *Cmd) Env(name, value string) *Cmd {
+	if c.env == nil {
+		c.env = make(map[string]string)
+	}
+	c.env[name] = value
+	return c
+}
+
+// ClearEnv stops the command from inheriting mage's environment, so that it
+// only gets the variables set with Env.  Environment variables in the command
+// and its arguments are expanded from those variables too.
+func (c *Cmd) ClearEnv() *Cmd {
+	c.clearEnv = true
+	return c
+}
+
+// Stdin sets where the command reads its input from.  Nil means it has no
+// input.
+func (c *Cmd) Stdin(r io.Reader) *Cmd {
+	c.stdin = r
+	return c
+}
+
+// Stdout sets where the command's output is written.  Nil discards it.
+func (c *Cmd) Stdout(w io.Writer) *Cmd {
+	c.stdout = w
+	return c
+}
+
+// Stderr sets where the command's error output is written.  Nil discards it.
+func (c *Cmd) Stderr(w io.Writer) *Cmd {
+	c.stderr = w
+	return c
+}
+
+// Context sets a context that stops the command if it's cancelled, as with
+// ExecCtx.
+func (c *Cmd) Context(ctx context.Context) *Cmd {
+	c.ctx = ctx
+	return c
+}
+
+// Timeout stops the command if it's still running after d, as with ExecCtx.
+// If the command is retried, each attempt gets its own timeout.
+func (c *Cmd) Timeout(d time.Duration) *Cmd {
+	c.timeout = d
+	return c
+}
+
+// Retry runs the command again if it exits with a non-zero exit code, up to
+// attempts times in all.  Retries wait for the delay set by RetryDelay before
+// the first retry, and twice as long before each one after that.  Attempts
+// that run out of the time set by Timeout are retried too, but commands that
+// can't be run at all aren't, and neither are commands whose context is
+// cancelled.  The output of a failed attempt is not kept by Output and
+// Capture.
+//
+// Each attempt reads stdin from where the first one started, so a reader set
+// with Stdin must be able to seek back to it, like a strings.Reader or
+// bytes.Reader.  Commands set to retry with a reader that can't are not run,
+// and return an error, since later attempts would get no input.  Files, such
+// as the default os.Stdin, are left as they are.
+func (c *Cmd) Retry(attempts int) *Cmd {
+	c.attempts = attempts
+	return c
+}
+
+// RetryDelay sets how long to wait before retrying the command the first time.
+// The default is one second.
+func (c *Cmd) RetryDelay(d time.Duration) *Cmd {
+	c.retryDelay = d
+	return c
+}
+
+// RetryOn only retries the command if it exits with one of the given codes.
+func (c *Cmd) RetryOn(codes ...int) *Cmd {
+	c.retryCodes = append(c.retryCodes, codes...)
+	return c
+}
+
+// RetryIf only retries the command if what it writes to stderr matches re.
+func (c *Cmd) RetryIf(re *regexp.Regexp) *Cmd {
+	c.retryIf = re
+	return c
+}
+
+// Run runs the command and waits for it to finish.
+func (c *Cmd) Run() error {
+	_, err := c.exec(func() {})
+	return err
+}
+
+// Output runs the command and returns what it writes to stdout, without a
+// trailing newline.
+func (c *Cmd) Output() (string, error) {
+	buf := &bytes.Buffer{}
+	c.stdout = buf
+	_, err := c.exec(buf.Reset)
+	return strings.TrimSuffix(buf.String(), "\n"), err
+}
+
+// Capture runs the command and returns what it writes to stdout and stderr.
+// Unlike Output, the output is returned as it was written.
+func (c *Cmd) Capture() (stdout, stderr string, err error) {
+	outBuf, errBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	c.stdout, c.stderr = outBuf, errBuf
+	_, err = c.exec(func() {
+		outBuf.Reset()
+		errBuf.Reset()
+	})
+	return outBuf.String(), errBuf.String(), err
+}
+
+// exec runs the command, retrying it if it's been set to, and translates its
+// errors as described for Exec.  Reset is called before each retry, to discard
+// the output of the failed attempt.
+func (c *Cmd) exec(reset func()) (ran bool, err error) {
+	cmd, args := c.expand()
+	if mg.DryRun() {
+		fmt.Fprintln(planOut, "exec:", c.format(cmd, args))
+		return true, nil
+	}
+	rewind, err := c.stdinRewinder()
+	if err != nil {
+		return false, err
+	}
+	delay := c.retryDelay
+	for attempt := 1; ; attempt++ {
+		ran, retry, err := c.attempt(cmd, args)
+		if err == nil || !retry || attempt >= c.attempts {
+			return ran, err
+		}
+		log.Printf("retrying %q (attempt %d of %d) after error: %v", cmd, attempt+1, c.attempts, err)
+		select {
+		case <-c.ctx.Done():
+			return ran, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		reset()
+		if err := rewind(); err != nil {
+			return ran, fmt.Errorf(`can't retry "%s": can't rewind its stdin: %v`, cmd, err)
+		}
+	}
+}
+
+// stdinRewinder returns a function that seeks the command's stdin back to
+// where it is now, so that retries read the same input.  It returns an error
+// if the command may be retried, and its stdin is a reader that can't seek.
+func (c *Cmd) stdinRewinder() (rewind func() error, err error) {
+	rewind = func() error { return nil }
+	if c.attempts <= 1 || c.stdin == nil {
+		return rewind, nil
+	}
+	if _, ok := c.stdin.(*os.File); ok {
+		return rewind, nil
+	}
+	s, ok := c.stdin.(io.Seeker)
+	if !ok {
+		return nil, fmt.Errorf(`can't retry "%s": its stdin can't be read again, since it can't seek`, c.name)
+	}
+	pos, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf(`can't retry "%s": its stdin can't be read again: %v`, c.name, err)
+	}
+	return func() error {
+		_, err := s.Seek(pos, io.SeekStart)
+		return err
+	}, nil
+}
+
+// attempt runs the command once, and reports whether it failed in a way that
+// should be retried.
+func (c *Cmd) attempt(cmd string, args []string) (ran, retry bool, err error) {
+	ctx, cancel := withTimeout(c.ctx, c.timeout)
+	defer cancel()
+	ec, flush := c.command(ctx, cmd, args)
+	stderr := &bytes.Buffer{}
+	if c.retryIf != nil {
+		if ec.Stderr != nil {
+			ec.Stderr = io.MultiWriter(ec.Stderr, stderr)
+		} else {
+			ec.Stderr = stderr
+		}
+	}
+	log.Println("exec:", cmd, strings.Join(args, " "))
+	runErr := runCmd(ctx, ec)
+	flush()
+	ran, err = translate(ctx, runErr, cmd, args)
+	switch {
+	case err == nil || c.ctx.Err() != nil:
+		return ran, false, err
+	case ctx.Err() != nil:
+		// only this attempt timed out.
+		return ran, true, err
+	case !ran:
+		return ran, false, err
+	case c.retryIf != nil && !c.retryIf.Match(stderr.Bytes()):
+		return ran, false, err
+	case len(c.retryCodes) == 0:
+		return ran, true, err
+	}
+	code := ExitStatus(runErr)
+	for _, rc := range c.retryCodes {
+		if code == rc {
+			return ran, true, err
+		}
+	}
+	return ran, false, err
+}
+
+// expand returns the command and its arguments with references to environment
+// variables expanded.
+func (c *Cmd) expand() (cmd string, args []string) {
+	expand := func(s string) string {
+		s2, ok := c.env[s]
+		if ok || c.clearEnv {
+			return s2
+		}
+		return os.Getenv(s)
+	}
+	cmd = os.Expand(c.name, expand)
+	// expand into a copy, so that running the command again expands the
+	// arguments as they were given.
+	args = make([]string, len(c.args))
+	for i, arg := range c.args {
+		args[i] = os.Expand(arg, expand)
+	}
+	return cmd, args
+}
+
+// format formats the command the way it would be typed into a shell, for a
+// dry run.
+func (c *Cmd) format(cmd string, args []string) string {
+	line := formatCmd(c.env, cmd, args)
+	if c.clearEnv {
+		line = "env -i " + line
+	}
+	if c.dir != "" {
+		line = "cd " + quote(c.dir) + " && " + line
+	}
+	return line
+}
+
+// command returns an exec.Cmd that runs cmd as set up by c, with its output
+// handled as for a command run with ctx, and a function to call once it has
+// finished.
+func (c *Cmd) command(ctx context.Context, cmd string, args []string) (ec *exec.Cmd, flush func()) {
+	ec = exec.Command(cmd, args...)
+	// a nil Env would inherit mage's environment.
+	ec.Env = []string{}
+	if !c.clearEnv {
+		for _, kv := range os.Environ() {
+			// where the compiled magefile records dependencies is only for
+			// mage itself.
+			if !strings.HasPrefix(kv, "MAGEFILE_TRACE_EVENTS=") {
+				ec.Env = append(ec.Env, kv)
+			}
+		}
+	}
+	for k, v := range c.env {
+		ec.Env = append(ec.Env, k+"="+v)
+	}
+	ec.Dir = c.dir
+	ec.Stdout, ec.Stderr, flush = commandOutput(ctx, c.stdout, c.stderr)
+	ec.Stdin = c.stdin
+	return ec, flush
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, func()) {
+	if d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {}
+}
+
+// translate returns the error to report for err, returned by running cmd with
+// ctx.  A command that ran and failed returns an error with its exit code, so
+// that mage will exit with the same code.
+func translate(ctx context.Context, err error, cmd string, args []string) (ran bool, _ error) {
+	if err == nil {
+		return true, nil
+	}
+	ran, code := CmdRan(err), ExitStatus(err)
+	if ctx.Err() != nil {
+		return ran, fmt.Errorf(`running "%s %s" was stopped: %v`, cmd, strings.Join(args, " "), ctx.Err())
+	}
+	if ran {
+		return ran, mg.Fatalf(code, `running "%s %s" failed with exit code %d`, cmd, strings.Join(args, " "), code)
+	}
+	return ran, fmt.Errorf(`failed to run "%s %s: %v"`, cmd, strings.Join(args, " "), err)
+}
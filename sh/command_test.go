@@ -0,0 +1,158 @@
+package sh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/magefile/mage/mg"
+)
+
+func TestCommandDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe, err := filepath.Abs(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Command(exe, "-printDir").Dir(dir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temp dir may be behind a symlink, as on macOS.
+	expected, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, _ := filepath.EvalSymlinks(out); actual != expected {
+		t.Fatalf("expected command to run in %q, but it ran in %q", expected, out)
+	}
+}
+
+func TestCommandEnv(t *testing.T) {
+	os.Setenv("MAGE_COMMAND_TEST", "inherited")
+	defer os.Unsetenv("MAGE_COMMAND_TEST")
+
+	out, err := Command(os.Args[0], "-printVar", "MAGE_COMMAND_TEST").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "inherited" {
+		t.Fatalf("expected inherited variable, got %q", out)
+	}
+
+	out, err = Command(os.Args[0], "-printVar", "MAGE_COMMAND_TEST").Env("MAGE_COMMAND_TEST", "set").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "set" {
+		t.Fatalf("expected variable set with Env, got %q", out)
+	}
+
+	out, err = Command(os.Args[0], "-printVar", "MAGE_COMMAND_TEST").ClearEnv().Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" {
+		t.Fatalf("expected no variable with a cleared environment, got %q", out)
+	}
+}
+
+func TestCommandRunTwice(t *testing.T) {
+	os.Setenv("MAGE_COMMAND_TEST", "first")
+	defer os.Unsetenv("MAGE_COMMAND_TEST")
+	cmd := Command(os.Args[0], "-printArgs", "$MAGE_COMMAND_TEST")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "[first]" {
+		t.Fatalf("expected [first], got %q", out)
+	}
+	os.Setenv("MAGE_COMMAND_TEST", "second")
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "[second]" {
+		t.Fatalf("expected the arguments to be expanded again, got %q", out)
+	}
+}
+
+func TestCommandTraceEnv(t *testing.T) {
+	os.Setenv("MAGEFILE_TRACE_EVENTS", "1:3")
+	defer os.Unsetenv("MAGEFILE_TRACE_EVENTS")
+	out, err := Command(os.Args[0], "-printVar", "MAGEFILE_TRACE_EVENTS").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" {
+		t.Fatalf("expected commands not to inherit where mage records events, got %q", out)
+	}
+}
+
+func TestCommandCapture(t *testing.T) {
+	stdout, stderr, err := Command(os.Args[0], "-helper", "-stdout", "out", "-stderr", "err").Capture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != "out\n" || stderr != "err\n" {
+		t.Fatalf("expected stdout %q and stderr %q, got %q and %q", "out\n", "err\n", stdout, stderr)
+	}
+}
+
+func TestCommandStdin(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := Command(os.Args[0], "-cat").Stdin(strings.NewReader("input")).Stdout(buf).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "input" {
+		t.Fatalf("expected %q, got %q", "input", buf)
+	}
+}
+
+func TestCommandExitCode(t *testing.T) {
+	err := Command(os.Args[0], "-helper", "-exit", "3").Stderr(nil).Run()
+	if err == nil {
+		t.Fatal("expected error from failing command")
+	}
+	if code := mg.ExitStatus(err); code != 3 {
+		t.Fatalf("expected exit status 3, got %d", code)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	start := time.Now()
+	err := Command(os.Args[0], "-helper", "-sleep", "10s").Timeout(100 * time.Millisecond).Run()
+	if err == nil || !strings.Contains(err.Error(), "context deadline exceeded") {
+		t.Fatalf("expected command to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("expected command to be stopped after the timeout, but it took %v", d)
+	}
+}
+
+func TestCommandDryRun(t *testing.T) {
+	os.Setenv(mg.DryRunEnv, "1")
+	defer os.Unsetenv(mg.DryRunEnv)
+	buf := &bytes.Buffer{}
+	defaultOut := planOut
+	planOut = buf
+	defer func() { planOut = defaultOut }()
+
+	if err := Command("go", "test").Dir("my api").Env("CGO_ENABLED", "0").ClearEnv().Run(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `exec: cd "my api" && env -i CGO_ENABLED=0 go test` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf)
+	}
+}
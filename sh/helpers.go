@@ -4,11 +4,18 @@ import (
 	"fmt"
 	"io"
 	"os"
+
+	"github.com/magefile/mage/mg"
 )
 
 // Rm removes the given file or directory even if non-empty. It will not return
 // an error if the target doesn't exist, only if the target cannot be removed.
+// In a dry run, Rm prints the path instead of removing it.
 func Rm(path string) error {
+	if mg.DryRun() {
+		fmt.Fprintln(planOut, "rm:", path)
+		return nil
+	}
 	err := os.RemoveAll(path)
 	if err == nil || os.IsNotExist(err) {
 		return nil
@@ -17,7 +24,12 @@ func Rm(path string) error {
 }
 
 // Copy robustly copies the source file to the destination, overwriting the destination if necessary.
+// In a dry run, Copy prints the paths instead of copying.
 func Copy(dst string, src string) error {
+	if mg.DryRun() {
+		fmt.Fprintln(planOut, "copy:", src, dst)
+		return nil
+	}
 	from, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf(`can't copy %s: %v`, src, err)
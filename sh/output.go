@@ -0,0 +1,87 @@
+package sh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/magefile/mage/mg"
+)
+
+// commandOutput returns the writers a command run with ctx should write its
+// stdout and stderr to.  If the magefile was run with the prefix or buffer
+// flags, output meant for this program's stdout or stderr is written a line at
+// a time, prefixed with the name of the dependency running the command if
+// requested, through mg.OutputTo.  Other writers are returned unchanged.  The
+// returned function must be called once the command has finished, to write any
+// final line that didn't end in a newline.
+func commandOutput(ctx context.Context, stdout, stderr io.Writer) (io.Writer, io.Writer, func()) {
+	prefix, buffer := mg.Prefix(), mg.Buffer()
+	if !prefix && !buffer {
+		return stdout, stderr, func() {}
+	}
+	var p string
+	if name := mg.CurrentTarget(ctx); prefix && name != "" {
+		p = "[" + name + "] "
+	}
+	var flushes []func()
+	wrap := func(w io.Writer) io.Writer {
+		if w != io.Writer(os.Stdout) && w != io.Writer(os.Stderr) {
+			return w
+		}
+		lw := &lineWriter{w: mg.OutputTo(ctx, w), prefix: []byte(p)}
+		flushes = append(flushes, lw.flush)
+		return lw
+	}
+	stdout, stderr = wrap(stdout), wrap(stderr)
+	return stdout, stderr, func() {
+		for _, f := range flushes {
+			f()
+		}
+	}
+}
+
+// lineWriter writes each complete line written to it to w in a single write,
+// preceded by prefix.
+type lineWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := l.writeLine(l.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush writes the last line, if it didn't end in a newline.
+func (l *lineWriter) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buf) > 0 {
+		l.writeLine(append(l.buf, '\n'))
+		l.buf = nil
+	}
+}
+
+func (l *lineWriter) writeLine(line []byte) error {
+	b := make([]byte, 0, len(l.prefix)+len(line))
+	b = append(append(b, l.prefix...), line...)
+	_, err := l.w.Write(b)
+	return err
+}
@@ -0,0 +1,103 @@
+package sh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/magefile/mage/mg"
+)
+
+func TestPrefix(t *testing.T) {
+	os.Setenv(mg.PrefixEnv, "1")
+	defer os.Unsetenv(mg.PrefixEnv)
+	os.Setenv(mg.TargetEnv, "Build")
+	defer os.Unsetenv(mg.TargetEnv)
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	_, err = Exec(nil, os.Stdout, nil, os.Args[0], "-helper", "-stdout", "one\ntwo")
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[Build] one\n[Build] two\n"
+	if string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+}
+
+// commands run without a context by a dependency started with mg.Deps are
+// still labelled with, and held until the end of, that dependency.
+func TestPrefixDeps(t *testing.T) {
+	os.Setenv(mg.PrefixEnv, "1")
+	defer os.Unsetenv(mg.PrefixEnv)
+	os.Setenv(mg.BufferEnv, "1")
+	defer os.Unsetenv(mg.BufferEnv)
+	os.Setenv(mg.TargetEnv, "Build")
+	defer os.Unsetenv(mg.TargetEnv)
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	mg.Deps(prefixDep)
+	os.Stdout = stdout
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[github.com/magefile/mage/sh.prefixDep] one\n[github.com/magefile/mage/sh.prefixDep] two\n"
+	if string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+}
+
+func prefixDep() error {
+	return RunV(os.Args[0], "-helper", "-stdout", "one\ntwo")
+}
+
+func TestPrefixOtherWriters(t *testing.T) {
+	os.Setenv(mg.PrefixEnv, "1")
+	defer os.Unsetenv(mg.PrefixEnv)
+	os.Setenv(mg.TargetEnv, "Build")
+	defer os.Unsetenv(mg.TargetEnv)
+
+	// output that's captured isn't meant for the user, so it's left alone.
+	s, err := Output(os.Args[0], "-printArgs", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "[foo]" {
+		t.Fatalf("expected %q, got %q", "[foo]", s)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := &lineWriter{w: buf, prefix: []byte("> ")}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthr"))
+	if buf.String() != "> one\n> two\n" {
+		t.Fatalf("expected only complete lines to be written, got %q", buf)
+	}
+	w.flush()
+	if buf.String() != "> one\n> two\n> thr\n" {
+		t.Fatalf("expected flush to write the last line, got %q", buf)
+	}
+}
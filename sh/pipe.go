@@ -0,0 +1,129 @@
+package sh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/magefile/mage/mg"
+)
+
+// Pipeline is a series of commands, each reading what the one before it
+// writes, like a shell pipeline.  The commands are connected directly, rather
+// than by running a shell, so their arguments don't need to be quoted and it
+// works the same on every OS:
+//
+//  out, err := sh.Pipe(
+//      sh.Command("git", "ls-files"),
+//      sh.Command("grep", `\.go$`),
+//      sh.Command("xargs", "gofmt", "-l"),
+//  ).Output()
+//
+// Each command is run as set up with Cmd's methods, except that the stdout of
+// each command but the last, and the stdin of each command but the first, are
+// the pipes between them.  Contexts and timeouts are set on the whole
+// pipeline, not on its commands.
+type Pipeline struct {
+	cmds    []*Cmd
+	ctx     context.Context
+	timeout time.Duration
+}
+
+// Pipe returns a Pipeline that runs cmds.
+func Pipe(cmds ...*Cmd) *Pipeline {
+	return &Pipeline{cmds: cmds, ctx: context.Background()}
+}
+
+// Context sets a context that stops all the commands if it's cancelled, as with
+// ExecCtx.
+func (p *Pipeline) Context(ctx context.Context) *Pipeline {
+	p.ctx = ctx
+	return p
+}
+
+// Timeout stops all the commands if the pipeline is still running after d.
+func (p *Pipeline) Timeout(d time.Duration) *Pipeline {
+	p.timeout = d
+	return p
+}
+
+// Run runs the commands and waits for all of them to finish.  If any of them
+// fail, the error is for the first one that failed, so that mage will exit
+// with its exit code (see ExitStatus).
+func (p *Pipeline) Run() error {
+	if len(p.cmds) == 0 {
+		return nil
+	}
+	type stage struct {
+		cmd  string
+		args []string
+	}
+	stages := make([]stage, len(p.cmds))
+	lines := make([]string, len(p.cmds))
+	for i, c := range p.cmds {
+		stages[i].cmd, stages[i].args = c.expand()
+		lines[i] = c.format(stages[i].cmd, stages[i].args)
+	}
+	if mg.DryRun() {
+		fmt.Fprintln(planOut, "exec:", strings.Join(lines, " | "))
+		return nil
+	}
+
+	cmds := make([]*exec.Cmd, len(p.cmds))
+	var flushes []func()
+	var closeAfterStart []io.Closer
+	var stdin *os.File
+	for i, c := range p.cmds {
+		ec, flush := c.command(p.ctx, stages[i].cmd, stages[i].args)
+		flushes = append(flushes, flush)
+		if i > 0 {
+			ec.Stdin = stdin
+		}
+		if i < len(p.cmds)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				for _, f := range closeAfterStart {
+					f.Close()
+				}
+				return fmt.Errorf("can't create pipe: %v", err)
+			}
+			ec.Stdout = w
+			stdin = r
+			closeAfterStart = append(closeAfterStart, r, w)
+		}
+		cmds[i] = ec
+	}
+
+	ctx, cancel := withTimeout(p.ctx, p.timeout)
+	defer cancel()
+	log.Println("exec:", strings.Join(lines, " | "))
+	errs := runCmds(ctx, cmds, closeAfterStart)
+	for _, f := range flushes {
+		f()
+	}
+	for i, err := range errs {
+		if err != nil {
+			_, err := translate(ctx, err, stages[i].cmd, stages[i].args)
+			return err
+		}
+	}
+	return nil
+}
+
+// Output runs the commands and returns what the last one writes to stdout,
+// without a trailing newline.
+func (p *Pipeline) Output() (string, error) {
+	if len(p.cmds) == 0 {
+		return "", nil
+	}
+	buf := &bytes.Buffer{}
+	p.cmds[len(p.cmds)-1].stdout = buf
+	err := p.Run()
+	return strings.TrimSuffix(buf.String(), "\n"), err
+}
@@ -0,0 +1,57 @@
+package sh
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/magefile/mage/mg"
+)
+
+func TestPipe(t *testing.T) {
+	out, err := Pipe(
+		Command(os.Args[0], "-helper", "-stdout", "one two").Stderr(nil),
+		Command(os.Args[0], "-cat"),
+		Command(os.Args[0], "-cat"),
+	).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "one two" {
+		t.Fatalf("expected %q, got %q", "one two", out)
+	}
+}
+
+func TestPipeExitStatus(t *testing.T) {
+	err := Pipe(
+		Command(os.Args[0], "-cat").Stdin(nil),
+		Command(os.Args[0], "-helper", "-exit", "3").Stderr(nil),
+		// the last command reads all its input, so the one before it can't fail
+		// writing to it.
+		Command(os.Args[0], "-cat", "-helper", "-exit", "5").Stderr(nil),
+	).Run()
+	if err == nil {
+		t.Fatal("expected error from failing pipeline")
+	}
+	if code := ExitStatus(err); code != 3 {
+		t.Fatalf("expected exit status of the first failing command, 3, got %d: %v", code, err)
+	}
+}
+
+func TestPipeDryRun(t *testing.T) {
+	os.Setenv(mg.DryRunEnv, "1")
+	defer os.Unsetenv(mg.DryRunEnv)
+	buf := &bytes.Buffer{}
+	defaultOut := planOut
+	planOut = buf
+	defer func() { planOut = defaultOut }()
+
+	err := Pipe(Command("git", "ls-files"), Command("grep", `\.go$`), Command("xargs", "gofmt", "-l")).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `exec: git ls-files | grep "\\.go$" | xargs gofmt -l` + "\n"
+	if buf.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, buf)
+	}
+}
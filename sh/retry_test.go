@@ -0,0 +1,131 @@
+package sh
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyCmd returns a command that fails with the given exit code and stderr
+// the given number of times before succeeding, and a function that returns how
+// many times it has run.
+func flakyCmd(t *testing.T, failures, code int, stderr string) (cmd *Cmd, runs func() int, cleanup func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "runs")
+	cmd = Command(os.Args[0], "-helper", "-flaky", f, "-failures", strconv.Itoa(failures),
+		"-exit", strconv.Itoa(code), "-stderr", stderr, "-stdout", "attempt").
+		Stderr(nil).
+		RetryDelay(time.Millisecond)
+	runs = func() int {
+		b, _ := ioutil.ReadFile(f)
+		n, _ := strconv.Atoi(string(b))
+		return n
+	}
+	return cmd, runs, func() { os.RemoveAll(dir) }
+}
+
+func TestRetry(t *testing.T) {
+	cmd, runs, cleanup := flakyCmd(t, 2, 1, "")
+	defer cleanup()
+	out, err := cmd.Retry(3).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs())
+	}
+	// the output of the failed attempts should be discarded.
+	if out != "attempt" {
+		t.Fatalf("expected output of the last attempt, got %q", out)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	cmd, runs, cleanup := flakyCmd(t, 5, 7, "")
+	defer cleanup()
+	err := cmd.Retry(3).Run()
+	if code := ExitStatus(err); code != 7 {
+		t.Fatalf("expected exit status 7, got %d (%v)", code, err)
+	}
+	if runs() != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs())
+	}
+}
+
+func TestRetryOn(t *testing.T) {
+	cmd, runs, cleanup := flakyCmd(t, 1, 2, "")
+	defer cleanup()
+	if err := cmd.Retry(3).RetryOn(1).Run(); ExitStatus(err) != 2 {
+		t.Fatalf("expected exit status 2, got %v", err)
+	}
+	if runs() != 1 {
+		t.Fatalf("expected no retry for another exit code, got %d runs", runs())
+	}
+
+	cmd, runs, cleanup = flakyCmd(t, 1, 2, "")
+	defer cleanup()
+	if err := cmd.Retry(3).RetryOn(1, 2).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 2 {
+		t.Fatalf("expected a retry for a listed exit code, got %d runs", runs())
+	}
+}
+
+func TestRetryIf(t *testing.T) {
+	re := regexp.MustCompile(`connection (refused|reset)`)
+	cmd, runs, cleanup := flakyCmd(t, 1, 1, "syntax error")
+	defer cleanup()
+	if err := cmd.Retry(3).RetryIf(re).Run(); err == nil {
+		t.Fatal("expected error")
+	}
+	if runs() != 1 {
+		t.Fatalf("expected no retry when stderr doesn't match, got %d runs", runs())
+	}
+
+	cmd, runs, cleanup = flakyCmd(t, 1, 1, "dial tcp: connection refused")
+	defer cleanup()
+	if err := cmd.Retry(3).RetryIf(re).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 2 {
+		t.Fatalf("expected a retry when stderr matches, got %d runs", runs())
+	}
+}
+
+func TestRetryStdin(t *testing.T) {
+	cmd, runs, cleanup := flakyCmd(t, 2, 1, "")
+	defer cleanup()
+	out, err := cmd.Args("-cat").Stdin(strings.NewReader("input ")).Retry(3).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs() != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs())
+	}
+	// each attempt should have read all of the input.
+	if out != "input attempt" {
+		t.Fatalf("expected the input followed by the output of the last attempt, got %q", out)
+	}
+}
+
+func TestRetryStdinCantSeek(t *testing.T) {
+	cmd, runs, cleanup := flakyCmd(t, 2, 1, "")
+	defer cleanup()
+	err := cmd.Args("-cat").Stdin(io.MultiReader(strings.NewReader("input"))).Retry(3).Run()
+	if err == nil {
+		t.Fatal("expected an error for a stdin that can't be read again")
+	}
+	if runs() != 0 {
+		t.Fatalf("expected the command not to run, got %d runs", runs())
+	}
+}
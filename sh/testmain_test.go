@@ -3,8 +3,14 @@ package sh
 import (
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var (
@@ -14,6 +20,12 @@ var (
 	stdout    string
 	exitCode  int
 	printVar  string
+	sleep     time.Duration
+	noTerm    bool
+	printDir  bool
+	cat       bool
+	flaky     string
+	failures  int
 )
 
 func init() {
@@ -23,6 +35,12 @@ func init() {
 	flag.StringVar(&stdout, "stdout", "", "")
 	flag.IntVar(&exitCode, "exit", 0, "")
 	flag.StringVar(&printVar, "printVar", "", "")
+	flag.DurationVar(&sleep, "sleep", 0, "")
+	flag.BoolVar(&noTerm, "noTerm", false, "")
+	flag.BoolVar(&printDir, "printDir", false, "")
+	flag.BoolVar(&cat, "cat", false, "")
+	flag.StringVar(&flaky, "flaky", "", "")
+	flag.IntVar(&failures, "failures", 0, "")
 }
 
 func TestMain(m *testing.M) {
@@ -36,10 +54,35 @@ func TestMain(m *testing.M) {
 		fmt.Println(os.Getenv(printVar))
 		return
 	}
+	if printDir {
+		wd, _ := os.Getwd()
+		fmt.Println(wd)
+		return
+	}
+	if cat {
+		io.Copy(os.Stdout, os.Stdin)
+		if !helperCmd {
+			return
+		}
+	}
 
 	if helperCmd {
+		if noTerm {
+			signal.Ignore(syscall.SIGTERM)
+		}
+		time.Sleep(sleep)
 		fmt.Fprintln(os.Stderr, stderr)
 		fmt.Fprintln(os.Stdout, stdout)
+		if flaky != "" {
+			// count the runs in the flaky file, and only fail the first few.
+			b, _ := ioutil.ReadFile(flaky)
+			runs, _ := strconv.Atoi(string(b))
+			runs++
+			ioutil.WriteFile(flaky, []byte(strconv.Itoa(runs)), 0644)
+			if runs > failures {
+				os.Exit(0)
+			}
+		}
 		os.Exit(exitCode)
 	}
 	os.Exit(m.Run())
@@ -0,0 +1,73 @@
+package target
+
+import (
+	"os"
+
+	"github.com/magefile/mage/internal"
+)
+
+// Glob reports whether any of the sources have been modified more recently
+// than the destination, and if so, which source is the most recently
+// modified, which is useful for logging why dst is being rebuilt.  If the
+// destination is a directory, the modtimes of the files under it are compared
+// instead, as with Dir.  If the destination doesn't exist, it always returns
+// true, "" and nil.
+//
+// Sources that are directories include all the files under them.  Sources
+// containing any of the characters *?[ are patterns, which are matched with
+// path.Match against the slash separated paths of the files under the current
+// directory, relative to it.  "**" in a pattern matches any number of
+// directories, and patterns starting with "!" exclude the files matched by
+// other patterns, so for example
+//
+//     target.Glob("bin/app", "**/*.go", "go.mod", "!testdata/**", "!**/*_test.go")
+//
+// compares bin/app with go.mod and all the non-test go files outside of
+// testdata directories.  Directories starting with "." are not searched.  It's
+// an error if any sources that aren't patterns don't exist.
+func Glob(dst string, sources ...string) (rebuild bool, newest string, err error) {
+	stat, err := os.Stat(dst)
+	if os.IsNotExist(err) {
+		return true, "", nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	dstTime := stat.ModTime()
+	if stat.IsDir() {
+		dstTime, err = calDirModTimeRecursive(dst, stat)
+		if err != nil {
+			return false, "", err
+		}
+	}
+	files, err := internal.ExpandSources(sources)
+	if err != nil {
+		return false, "", err
+	}
+	latest := dstTime
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false, "", err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+			newest = f
+		}
+	}
+	return newest != "", newest, nil
+}
+
+// Outputs reports whether any of the destinations are missing or have been
+// modified less recently than the newest of the sources, and returns those
+// that are, in the order given, so that only they can be rebuilt.
+// Destinations that are directories are compared by the modtimes of the files
+// under them, as with Dir.  Sources may be files, directories or patterns, as
+// with Glob.  It's an error if any sources that aren't patterns don't exist.
+func Outputs(dsts []string, sources ...string) (rebuild bool, stale []string, err error) {
+	stale, err = internal.StaleOutputs(dsts, sources)
+	if err != nil {
+		return false, nil, err
+	}
+	return len(stale) > 0, stale, nil
+}
@@ -0,0 +1,110 @@
+package target
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGlob(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{
+		"main.go":          "package main",
+		"main_test.go":     "package main",
+		"go.mod":           "module foo",
+		"cmd/app/app.go":   "package app",
+		"testdata/data.go": "package data",
+		"app":              "binary",
+	})
+	sources := []string{"**/*.go", "go.mod", "!testdata/**", "!**/*_test.go"}
+	touch := func(name string, d time.Duration) {
+		ts := time.Now().Add(d)
+		if err := os.Chtimes(name, ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(expected bool, expectedNewest string) {
+		t.Helper()
+		rebuild, newest, err := Glob("app", sources...)
+		if err != nil {
+			t.Fatal("Expected no error, but got", err)
+		}
+		if rebuild != expected || newest != expectedNewest {
+			t.Fatalf("expected %v, %q, but got %v, %q", expected, expectedNewest, rebuild, newest)
+		}
+	}
+	for _, name := range []string{"main.go", "main_test.go", "go.mod", "cmd/app/app.go", "testdata/data.go"} {
+		touch(name, -time.Hour)
+	}
+	check(false, "")
+
+	// excluded files don't cause a rebuild
+	touch("testdata/data.go", time.Hour)
+	touch("main_test.go", time.Hour)
+	check(false, "")
+
+	touch("go.mod", time.Hour)
+	touch("cmd/app/app.go", 2*time.Hour)
+	check(true, "cmd/app/app.go")
+}
+
+func TestGlobMissingDest(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	rebuild, newest, err := Glob("missing", "*.go")
+	if err != nil {
+		t.Fatal("Expected no error, but got", err)
+	}
+	if !rebuild || newest != "" {
+		t.Fatalf("expected true, \"\", but got %v, %q", rebuild, newest)
+	}
+}
+
+func TestGlobMissingSource(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{"app": "binary"})
+	if _, _, err := Glob("app", "missing"); err == nil {
+		t.Fatal("expected error, but got nil")
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{
+		"proto/a.proto": "a",
+		"proto/b.proto": "b",
+		"gen/a.pb.go":   "a",
+		"gen/b.pb.go":   "b",
+	})
+	touch := func(name string, d time.Duration) {
+		ts := time.Now().Add(d)
+		if err := os.Chtimes(name, ts, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch("proto/a.proto", -2*time.Hour)
+	touch("proto/b.proto", -time.Hour)
+	touch("gen/a.pb.go", -90*time.Minute)
+	dsts := []string{"gen/a.pb.go", "gen/b.pb.go", "gen/c.pb.go"}
+
+	rebuild, stale, err := Outputs(dsts, "proto/*.proto")
+	if err != nil {
+		t.Fatal("Expected no error, but got", err)
+	}
+	expected := []string{"gen/a.pb.go", "gen/c.pb.go"}
+	if !rebuild || !reflect.DeepEqual(stale, expected) {
+		t.Fatalf("expected true, %v, but got %v, %v", expected, rebuild, stale)
+	}
+
+	rebuild, stale, err = Outputs(dsts[1:2], "proto/*.proto")
+	if err != nil {
+		t.Fatal("Expected no error, but got", err)
+	}
+	if rebuild || len(stale) != 0 {
+		t.Fatalf("expected false, [], but got %v, %v", rebuild, stale)
+	}
+}
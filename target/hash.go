@@ -0,0 +1,217 @@
+package target
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/magefile/mage/internal"
+	"github.com/magefile/mage/mg"
+)
+
+// StateDir is the directory where Hash and SaveHash keep the digests of the
+// sources each destination was built from.  It may be set to a directory in
+// the project, for example to share the state with a CI cache.  If it is
+// empty, the "targets" directory under mg.CacheDir() is used.
+var StateDir = ""
+
+// Hash reports whether dst needs to be rebuilt because the contents of the
+// sources have changed since SaveHash was last called for dst.  Unlike Path
+// and Dir, modification times are ignored, so sources that have been touched
+// or checked out again without changing don't cause a rebuild.
+//
+// Sources may be files, directories or patterns, as with Glob.  It's an error
+// if any sources that aren't patterns don't exist.
+//
+// If dst doesn't exist, or there are no saved digests for it, Hash always
+// returns true and nil.  If dst has changed since SaveHash was called, Hash
+// also returns true.
+func Hash(dst string, sources ...string) (bool, error) {
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	current, err := newHashState(dst, sources)
+	if err != nil {
+		return false, err
+	}
+	saved, err := loadHashState(dst)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !current.equal(saved), nil
+}
+
+// SaveHash saves the digests of the sources and dst, for Hash to compare
+// against.  It should be called once dst has been built successfully, with
+// the same sources that were passed to Hash.
+func SaveHash(dst string, sources ...string) error {
+	state, err := newHashState(dst, sources)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := hashStatePath(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("can't create target state directory: %v", err)
+	}
+	// write to a temporary file and rename it, so that a failed write can't
+	// leave behind a state that looks up to date.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("can't save target state for %s: %v", dst, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// hashState is the content of a destination and its sources, as saved by
+// SaveHash.
+type hashState struct {
+	Dst     string            `json:"dst"`     // the digest of the destination
+	Sources map[string]string `json:"sources"` // the digest of each source file
+}
+
+func newHashState(dst string, sources []string) (*hashState, error) {
+	files, err := internal.ExpandSources(sources)
+	if err != nil {
+		return nil, err
+	}
+	state := &hashState{Sources: make(map[string]string, len(files))}
+	for _, f := range files {
+		d, err := internal.HashFile(f)
+		if err != nil {
+			return nil, err
+		}
+		state.Sources[filepath.ToSlash(f)] = d
+	}
+	state.Dst, err = hashPath(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *hashState) equal(other *hashState) bool {
+	if s.Dst != other.Dst || len(s.Sources) != len(other.Sources) {
+		return false
+	}
+	for f, d := range s.Sources {
+		if other.Sources[f] != d {
+			return false
+		}
+	}
+	return true
+}
+
+func loadHashState(dst string) (*hashState, error) {
+	path, err := hashStatePath(dst)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	state := &hashState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, fmt.Errorf("can't read target state for %s: %v", dst, err)
+	}
+	return state, nil
+}
+
+// hashStatePath returns the file where the state for dst is saved, which is
+// named for the path of dst relative to the root of the project, so that each
+// destination has its own, and checkouts of the project in different
+// directories can share a StateDir.  Destinations outside of the project are
+// named for their absolute path.
+func hashStatePath(dst string) (string, error) {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return "", err
+	}
+	name := abs
+	root, err := projectRoot(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		name = rel
+	}
+	dir := StateDir
+	if dir == "" {
+		dir = filepath.Join(mg.CacheDir(), "targets")
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(name)))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// projectRoot returns the root of the module that dir is in.  If it isn't in
+// a module, it returns the directory of the magefiles, or if that isn't known,
+// the current directory.
+func projectRoot(dir string) (string, error) {
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break
+		}
+		d = parent
+	}
+	if d := mg.MagefileDir(); d != "" {
+		return filepath.Abs(d)
+	}
+	return os.Getwd()
+}
+
+// hashPath returns the digest of the file or directory at path.  The digest
+// of a directory covers the names and contents of all the files under it.
+func hashPath(path string) (string, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !stat.IsDir() {
+		return internal.HashFile(path)
+	}
+	var lines []string
+	err = filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		d, err := internal.HashFile(name)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, name)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, filepath.ToSlash(rel)+" "+d)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,154 @@
+package target
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withHashDir changes to a new temporary directory, which is also used as the
+// StateDir, until the returned function is called.
+func withHashDir(t *testing.T) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	stateDir := StateDir
+	StateDir = filepath.Join(dir, ".state")
+	return dir, func() {
+		StateDir = stateDir
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func writeFiles(t *testing.T, files map[string]string) {
+	for name, contents := range files {
+		name = filepath.FromSlash(name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkHash(t *testing.T, expected bool, dst string, sources ...string) {
+	t.Helper()
+	rebuild, err := Hash(dst, sources...)
+	if err != nil {
+		t.Fatal("Expected no error, but got", err)
+	}
+	if rebuild != expected {
+		t.Fatalf("expected rebuild to be %v, but got %v", expected, rebuild)
+	}
+}
+
+func TestHash(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{
+		"main.go":          "package main",
+		"go.mod":           "module foo",
+		"cmd/app/app.go":   "package app",
+		"testdata/data.go": "package data",
+	})
+	sources := []string{"go.mod", "**/*.go", "!testdata/**"}
+
+	checkHash(t, true, "app", sources...)
+	writeFiles(t, map[string]string{"app": "binary"})
+	checkHash(t, true, "app", sources...)
+	if err := SaveHash("app", sources...); err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, false, "app", sources...)
+
+	// touching a source without changing it doesn't need a rebuild
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes("main.go", later, later); err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, false, "app", sources...)
+
+	// neither does changing an excluded file
+	writeFiles(t, map[string]string{"testdata/data.go": "package changed"})
+	checkHash(t, false, "app", sources...)
+
+	writeFiles(t, map[string]string{"cmd/app/app.go": "package changed"})
+	checkHash(t, true, "app", sources...)
+}
+
+func TestHashNewSource(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{"main.go": "package main", "app": "binary"})
+	if err := SaveHash("app", "*.go"); err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, false, "app", "*.go")
+	writeFiles(t, map[string]string{"other.go": "package main"})
+	checkHash(t, true, "app", "*.go")
+}
+
+func TestHashChangedDst(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{"src/a.txt": "a", "out/a.txt": "a"})
+	if err := SaveHash("out", "src"); err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, false, "out", "src")
+	writeFiles(t, map[string]string{"out/b.txt": "b"})
+	checkHash(t, true, "out", "src")
+}
+
+func TestHashMissingSource(t *testing.T) {
+	_, restore := withHashDir(t)
+	defer restore()
+	writeFiles(t, map[string]string{"app": "binary"})
+	if err := SaveHash("app", "missing"); err == nil {
+		t.Fatal("expected error, but got nil")
+	}
+	if _, err := Hash("app", "missing"); err == nil {
+		t.Fatal("expected error, but got nil")
+	}
+}
+
+func TestHashMovedCheckout(t *testing.T) {
+	dir, restore := withHashDir(t)
+	defer restore()
+	files := map[string]string{"go.mod": "module foo", "main.go": "package main", "bin/app": "binary"}
+	for _, checkout := range []string{"a", "b"} {
+		if err := os.Mkdir(checkout, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(checkout); err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, files)
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chdir("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveHash("bin/app", "*.go"); err != nil {
+		t.Fatal(err)
+	}
+	// a checkout of the same project in another directory shares the state.
+	if err := os.Chdir(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	checkHash(t, false, "bin/app", "*.go")
+}